@@ -2,12 +2,19 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/biter777/countries"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	log "github.com/sirupsen/logrus"
@@ -17,6 +24,10 @@ import (
 )
 
 var fileProcessors []sub.Processor
+var fileTemplate = sub.DefaultTemplate()
+var namedTemplates = map[string]*sub.Template{}
+var TEMPLATE_DIR = os.Getenv("TEMPLATE_DIR")
+var fileInclude, fileExclude []string
 var CONFIG_FILE = firstString(os.Getenv("CONFIG_FILE"), "config.yaml")
 
 // FirstString returns the first non-empty string
@@ -29,6 +40,9 @@ func firstString(ss ...string) string {
 	return ""
 }
 
+// commentLine 去掉换行, 上游的节点名写进注释时不能插入新的配置行
+var commentLine = strings.NewReplacer("\r", " ", "\n", " ").Replace
+
 func copyFileProcessors() []sub.Processor {
 	var cp = make([]sub.Processor, len(fileProcessors))
 	copy(cp, fileProcessors)
@@ -47,12 +61,12 @@ func splitKeyValue(s string, delim string) (k, v string) {
 
 func readConfig() error {
 	var processors = make([]sub.Processor, 0)
-	f, err := os.Open(CONFIG_FILE)
+	b, err := os.ReadFile(CONFIG_FILE)
 	if err != nil {
 		return err
 	}
 	viper.SetConfigType("yaml")
-	err = viper.ReadConfig(f)
+	err = viper.ReadConfig(bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
@@ -67,21 +81,267 @@ func readConfig() error {
 		processors = append(processors, sub.AddRuleIPCIDR(k, v))
 	}
 	fileProcessors = processors
+
+	fileInclude = viper.GetStringSlice("filter.include")
+	fileExclude = viper.GetStringSlice("filter.exclude")
+	if _, err = sub.ParseNodeFilter(fileInclude, fileExclude); err != nil {
+		return err
+	}
+
+	// 节点名无法识别国家时, 按服务器地址查询离线的MMDB
+	if mmdb := viper.GetString("geoip.mmdb"); mmdb != "" {
+		geoIP, err := sub.OpenGeoIP(mmdb, viper.GetString("geoip.resolver"))
+		if err != nil {
+			return err
+		}
+		log.Infof("Use GeoIP database %s", mmdb)
+		sub.UseGeoIP(geoIP)
+	}
+
+	// viper会把key转为小写(如alterId), template直接用yaml解析, 覆盖内置布局中出现的字段
+	var file struct {
+		Template yaml.Node `yaml:"template"`
+	}
+	if err = yaml.Unmarshal(b, &file); err != nil {
+		return err
+	}
+	if !file.Template.IsZero() {
+		tb, err := yaml.Marshal(&file.Template)
+		if err != nil {
+			return err
+		}
+		if fileTemplate, err = sub.ParseTemplate(tb, sub.DefaultTemplate()); err != nil {
+			return err
+		}
+		log.Infof("Load template from %s", CONFIG_FILE)
+	}
+	if err = fileTemplate.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", CONFIG_FILE, err)
+	}
+	return readTemplates(firstString(TEMPLATE_DIR, filepath.Join(filepath.Dir(CONFIG_FILE), "templates")))
+}
+
+// readTemplates 读取目录下的<name>.yaml作为命名布局, 供请求参数template=<name>选择
+// 每个布局覆盖配置文件中的布局, 目录不存在时忽略
+func readTemplates(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	templates := make(map[string]*sub.Template)
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		tpl, err := sub.ParseTemplate(b, fileTemplate)
+		if err == nil {
+			err = tpl.Validate()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".yaml")
+		log.Infof("Load template %s from %s", name, file)
+		templates[name] = tpl
+	}
+	namedTemplates = templates
 	return nil
 }
 
-func fetchUpStream(link string, ctx echo.Context) (res *http.Response, err error) {
+// requestFilter 配置文件中的过滤条件加上请求参数include, exclude
+func requestFilter(c echo.Context) (*sub.NodeFilter, error) {
+	include := append(append([]string{}, fileInclude...), c.QueryParams()["include"]...)
+	exclude := append(append([]string{}, fileExclude...), c.QueryParams()["exclude"]...)
+	return sub.ParseNodeFilter(include, exclude)
+}
+
+// requestTemplate 根据请求参数template选择布局, 缺省为配置文件中的布局
+func requestTemplate(c echo.Context) (*sub.Template, bool) {
+	name := c.QueryParam("template")
+	if name == "" {
+		return fileTemplate, true
+	}
+	tpl, ok := namedTemplates[name]
+	return tpl, ok
+}
+
+// upstreamError 上游返回了非200的状态码, 原样转发给客户端
+type upstreamError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream server returns error: %d", e.StatusCode)
+}
+
+func fetchUpStream(link string) (res *http.Response, err error) {
 	res, err = http.Get(link)
 	if err != nil {
-		_ = ctx.String(http.StatusInternalServerError, err.Error())
 		return nil, err
 	}
 	if res.StatusCode != 200 {
-		// cloning the response like this better?
-		ctx.Response().Writer.WriteHeader(res.StatusCode)
-		_, _ = io.Copy(ctx.Response().Writer, res.Body)
-		return nil, fmt.Errorf("upstream server returns error: %d", res.StatusCode)
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return nil, &upstreamError{StatusCode: res.StatusCode, Body: body}
+	}
+	return
+}
+
+// upstream 一个上游订阅的抓取和解析结果
+type upstream struct {
+	link    string
+	subType string
+	tag     string
+	res     *http.Response
+	remote  sub.ClashSub
+	usage   *sub.ClashDataUsage
+	err     error
+}
+
+// fetchUpStreams 并发抓取并解析全部上游订阅
+// types和tags按位置与links对应, 缺省时type自动识别, tag取订阅的域名
+func fetchUpStreams(links, types, tags []string) []*upstream {
+	var (
+		upstreams = make([]*upstream, len(links))
+		wg        sync.WaitGroup
+	)
+	for i := range links {
+		u := &upstream{link: links[i], tag: strconv.Itoa(i + 1)}
+		if i < len(types) {
+			u.subType = types[i]
+		}
+		if i < len(tags) && tags[i] != "" {
+			u.tag = tags[i]
+		} else if parsed, err := url.Parse(links[i]); err == nil && parsed.Host != "" {
+			u.tag = parsed.Host
+		}
+		upstreams[i] = u
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.res, u.err = fetchUpStream(u.link)
+			if u.err != nil {
+				return
+			}
+			defer u.res.Body.Close()
+			u.remote, u.usage, u.err = decodeRemote(u.res, u.subType)
+		}()
+	}
+	wg.Wait()
+	return upstreams
+}
+
+// loadRemote 并发抓取请求中的全部上游订阅并合并
+// 失败时已经写入了错误响应, ok为false, err为写入响应的错误
+func loadRemote(c echo.Context) (remote sub.ClashSub, upstreams []*upstream, ok bool, err error) {
+	params := c.QueryParams()
+	subLinks := params["sub"]
+	if len(subLinks) == 0 || subLinks[0] == "" {
+		return remote, nil, false, c.String(http.StatusBadRequest, "param \"sub\" missing")
+	}
+	upstreams = fetchUpStreams(subLinks, params["type"], params["tag"])
+	var sources []sub.Source
+	for _, u := range upstreams {
+		var ue *upstreamError
+		switch {
+		case errors.As(u.err, &ue):
+			return remote, nil, false, c.Blob(ue.StatusCode, echo.MIMETextPlainCharsetUTF8, ue.Body)
+		case u.res == nil:
+			return remote, nil, false, c.String(http.StatusInternalServerError, u.err.Error())
+		case u.err != nil:
+			return remote, nil, false, c.String(http.StatusBadRequest, u.link+": "+u.err.Error())
+		}
+		sources = append(sources, sub.Source{Tag: u.tag, Remote: u.remote})
+	}
+	return sub.Merge(sources, c.QueryParam("collision")), upstreams, true, nil
+}
+
+// dataUsage 多个订阅的流量信息之和, 都没有时返回nil
+func dataUsage(upstreams []*upstream) *sub.ClashDataUsage {
+	var total *sub.ClashDataUsage
+	for _, u := range upstreams {
+		usage := u.usage
+		if usage == nil {
+			var parsed sub.ClashDataUsage
+			if parsed.ParseResponse(u.res) != nil {
+				continue
+			}
+			usage = &parsed
+		}
+		if total == nil {
+			total = &sub.ClashDataUsage{}
+		}
+		total.Add(usage)
+	}
+	return total
+}
+
+// decodeRemote 按type解析上游订阅, type为空或auto时根据内容自动判断格式
+// 订阅内容自带流量信息时(SIP008)一并返回, 否则usage为nil
+func decodeRemote(res *http.Response, subType string) (remote sub.ClashSub, usage *sub.ClashDataUsage, err error) {
+	if subType == "" || subType == "auto" {
+		var body []byte
+		body, err = io.ReadAll(res.Body)
+		if err != nil {
+			return
+		}
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		switch format := sub.SniffFormat(body); format {
+		case sub.FormatClash:
+			subType = "clash"
+		case sub.FormatURIList:
+			subType = "uri"
+		case sub.FormatSIP008:
+			subType = "sip008"
+		default:
+			return remote, nil, fmt.Errorf("unsupported subscription format: %s", format)
+		}
+	}
+
+	var decode func(*http.Response) ([]sub.Node, error)
+	switch subType {
+	case "clash":
+		err = yaml.NewDecoder(res.Body).Decode(&remote)
+		return
+	case "ss":
+		var proxies []sub.SSItem
+		proxies, err = sub.DecodeSS(res)
+		for _, proxy := range proxies {
+			remote.Proxies = append(remote.Proxies, proxy.Node())
+		}
+		return
+	case "ssr":
+		var proxies []sub.SSRItem
+		proxies, err = sub.DecodeSSR(res)
+		for _, proxy := range proxies {
+			remote.Proxies = append(remote.Proxies, proxy.Node())
+		}
+		return
+	case "sip008":
+		remote.Proxies, usage, err = sub.DecodeSIP008(res)
+		return
+	case "uri":
+		decode = sub.DecodeURIList
+	case "vmess":
+		decode = sub.DecodeVMess
+	case "trojan":
+		decode = sub.DecodeTrojan
+	case "vless":
+		decode = sub.DecodeVLESS
+	case "hysteria":
+		decode = sub.DecodeHysteria
+	case "hysteria2", "hy2":
+		decode = sub.DecodeHysteria2
+	case "tuic":
+		decode = sub.DecodeTUIC
+	case "wireguard":
+		decode = sub.DecodeWireGuard
+	default:
+		return remote, nil, fmt.Errorf("unsupported type %q", subType)
 	}
+	remote.Proxies, err = decode(res)
 	return
 }
 
@@ -111,110 +371,152 @@ func main() {
 	e.Use(middleware.Logger())
 	e.HideBanner = true
 	e.GET("/", func(c echo.Context) (err error) {
-		subLink := c.QueryParam("sub")
-		subType := c.QueryParam("type")
-		if subLink == "" {
-			return c.String(http.StatusBadRequest, "param \"sub\" missing")
+		target, ok := sub.Targets[firstString(c.QueryParam("target"), "clash")]
+		if !ok {
+			return c.String(http.StatusBadRequest, "unsupported target "+c.QueryParam("target"))
+		}
+		tpl, ok := requestTemplate(c)
+		if !ok {
+			return c.String(http.StatusBadRequest, "unknown template "+c.QueryParam("template"))
+		}
+		// countries=HK,JP,SG!,US 替换布局中的国家列表, !表示Required
+		if c.QueryParam("countries") != "" {
+			specs, err := sub.ParseCountries(c.QueryParam("countries"))
+			if err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			tpl = tpl.WithCountries(specs)
 		}
-		res, err := fetchUpStream(subLink, c)
+		filter, err := requestFilter(c)
 		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		remote, upstreams, ok, err := loadRemote(c)
+		if !ok {
 			return err
 		}
-		if res.Body != nil {
-			defer func() {
-				_ = res.Body.Close()
-			}()
+		var dropped []string
+		if c.QueryParam("dedup") != "false" {
+			remote, dropped = sub.DedupNodes(remote)
 		}
 
-		var remote sub.ClashSub
-		switch subType {
-		case "clash", "":
-			err = yaml.NewDecoder(res.Body).Decode(&remote)
-			if err != nil {
-				return err
-			}
-		case "ss":
-			var proxies []sub.SSItem
-			proxies, err = sub.DecodeSS(res)
-			if err != nil {
-				return err
-			}
-			for _, proxy := range proxies {
-				node := sub.Node{
-					Name:     proxy.Name,
-					Type:     "ss",
-					Server:   proxy.Server,
-					Port:     proxy.Port,
-					Cipher:   proxy.Method,
-					Password: proxy.Password,
-					TFO:      true,
-					UDP:      true,
-				}
-				switch proxy.Plugins["plugin"] {
-				case "simple-obfs":
-					node.Plugin = "obfs"
-					node.PluginOpts = map[string]string{
-						"mode": proxy.Plugins["obfs"],
-						"host": proxy.Plugins["obfs-host"],
-					}
-				}
-				remote.Proxies = append(remote.Proxies, node)
-			}
-		case "ssr":
-			var proxies []sub.SSRItem
-			proxies, err = sub.DecodeSSR(res)
-			if err != nil {
-				return err
-			}
-			for _, proxy := range proxies {
-				remote.Proxies = append(remote.Proxies, sub.Node{
-					Name:          proxy.Remarks,
-					Type:          "ssr",
-					Server:        proxy.Server,
-					Port:          proxy.ServerPort,
-					Cipher:        proxy.Method,
-					Password:      proxy.Password,
-					Protocol:      proxy.Protocol,
-					ProtocolParam: proxy.ProtocolParam,
-					Obfs:          proxy.OBFS,
-					ObfsParam:     proxy.OBFSParam,
-					UDP:           true,
-				})
+		body := bytes.NewBuffer(nil)
+		if target.Comment != "" {
+			r := c.Request()
+			topLine := r.Host + r.URL.String()
+			topLine = target.Comment + " " + topLine + "\n"
+			body.WriteString(topLine)
+			if len(dropped) > 0 {
+				body.WriteString(target.Comment + " duplicate nodes dropped: " + commentLine(strings.Join(dropped, ", ")) + "\n")
 			}
 		}
-		body := bytes.NewBuffer(nil)
-		r := c.Request()
-		topLine := r.Host + r.URL.String()
-		topLine = "# " + topLine + "\n"
-		body.WriteString(topLine)
 		processors := copyFileProcessors()
 		if externalController := c.QueryParam("controller"); externalController != "" {
 			processors = append(processors, sub.SetExternalController(externalController))
 		}
 
+		var config sub.ClashSub
 		if c.QueryParam("pass") == "true" {
-			err = sub.Pass(remote, body, processors...)
+			config = sub.PassConfig(tpl.RenameNodes(remote, tpl.GeoMatcher()), processors...)
 		} else {
-			err = sub.Rewrite(remote, body,
+			remote.Proxies = filter.Apply(remote.Proxies, tpl.GeoMatcher())
+			config = tpl.Rewrite(remote,
 				c.QueryParam("empty"),
 				c.QueryParam("media") == "true",
 				processors...,
 			)
 		}
-		if err != nil {
+		if err = target.Render(config, body); err != nil {
 			return c.String(http.StatusInternalServerError, err.Error())
 		}
 
-		setHeader(res, c.Response(), false)
+		setHeader(upstreams[0].res, c.Response(), false)
+		if len(upstreams) > 1 || upstreams[0].usage != nil {
+			if usage := dataUsage(upstreams); usage != nil {
+				c.Response().Header().Set("Subscription-Userinfo", usage.Header())
+			}
+		}
 		if err = c.Stream(200, "application/octet-stream; charset=utf-8", body); err != nil {
 			return err
 		}
 		log.WithFields(log.Fields{
-			"sub":    subLink,
+			"sub":    c.QueryParams()["sub"],
 			"remote": c.Request().RemoteAddr,
 		}).Infof("fetch remote sub")
 		return
 	})
+	// 只返回节点, 供手写配置的proxy-providers引用
+	// country按国家代码过滤, 如HK,JP; filter按节点名的正则过滤
+	e.GET("/provider/proxies", func(c echo.Context) (err error) {
+		tpl, ok := requestTemplate(c)
+		if !ok {
+			return c.String(http.StatusBadRequest, "unknown template "+c.QueryParam("template"))
+		}
+		var codes []countries.CountryCode
+		for _, code := range strings.Split(c.QueryParam("country"), ",") {
+			if code = strings.TrimSpace(code); code == "" {
+				continue
+			}
+			cc := countries.ByName(code)
+			if cc == countries.Unknown {
+				return c.String(http.StatusBadRequest, "unknown country "+code)
+			}
+			codes = append(codes, cc)
+		}
+		var pattern *regexp.Regexp
+		if filter := c.QueryParam("filter"); filter != "" {
+			if pattern, err = regexp.Compile(filter); err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+		}
+		filter, err := requestFilter(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		remote, upstreams, ok, err := loadRemote(c)
+		if !ok {
+			return err
+		}
+		if c.QueryParam("dedup") != "false" {
+			remote, _ = sub.DedupNodes(remote)
+		}
+		geo := tpl.GeoMatcher()
+		nodes := filter.Apply(remote.Proxies, geo)
+		body := bytes.NewBuffer(nil)
+		if err = sub.RenderProxyProvider(sub.FilterProxies(nodes, geo, codes, pattern), body); err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		setHeader(upstreams[0].res, c.Response(), false)
+		return c.Stream(200, "application/octet-stream; charset=utf-8", body)
+	})
+	// 每个节点识别到的国家及来源, 用于排查节点被分到哪个国家分组
+	e.GET("/provider/geo", func(c echo.Context) (err error) {
+		tpl, ok := requestTemplate(c)
+		if !ok {
+			return c.String(http.StatusBadRequest, "unknown template "+c.QueryParam("template"))
+		}
+		remote, _, ok, err := loadRemote(c)
+		if !ok {
+			return err
+		}
+		body := bytes.NewBuffer(nil)
+		if err = sub.RenderGeoReport(remote.Proxies, tpl.GeoMatcher(), body); err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.Stream(200, "text/plain; charset=utf-8", body)
+	})
+	// 内置的规则列表, 供手写配置的rule-providers引用, behavior为classical
+	e.GET("/provider/rules/:name", func(c echo.Context) (err error) {
+		tpl, ok := requestTemplate(c)
+		if !ok {
+			return c.String(http.StatusBadRequest, "unknown template "+c.QueryParam("template"))
+		}
+		body := bytes.NewBuffer(nil)
+		if err = tpl.RenderRuleProvider(c.Param("name"), body); err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		return c.Stream(200, "application/octet-stream; charset=utf-8", body)
+	})
 	port := firstString(os.Getenv("PORT"), "8080")
 	log.Infof("binding to port %s", port)
 	if err = e.Start(":" + port); err != nil {
@@ -0,0 +1,153 @@
+package sub
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// RenderClashMeta 输出Clash.Meta配置, relay分组改写为带dialer-proxy的节点, 见dialerChains
+func RenderClashMeta(config ClashSub, out io.Writer) error {
+	return RenderClash(dialerChains(config), out)
+}
+
+// dialerChains 将relay分组改写为Clash.Meta的dialer-proxy
+//
+// relay分组[自建服务器2深圳, 🇯🇵JP]中最后一跳的每个节点复制一份, 名为"<节点> (<relay分组名>)",
+// dialer-proxy指向前一跳, relay分组改为同名的select分组, 成员为这些副本, 引用该分组的地方不受影响.
+// 中间的跳只能是节点, 最后一跳是分组时展开其中的节点. 不足两跳的改为select, 其他无法改写的relay分组原样保留
+func dialerChains(config ClashSub) ClashSub {
+	nodes := make(map[string]Node)
+	seen := make(map[string]bool)
+	for _, node := range config.Proxies {
+		nodes[node.Name] = node
+		seen[node.Name] = true
+	}
+	groups := make(map[string]ProxyGroup)
+	for _, g := range config.ProxyGroups {
+		groups[g.Name] = g
+		seen[g.Name] = true
+	}
+
+	proxies := append([]Node(nil), config.Proxies...)
+	proxyGroups := make([]ProxyGroup, len(config.ProxyGroups))
+	for i, g := range config.ProxyGroups {
+		proxyGroups[i] = g
+		if g.Type != "relay" {
+			continue
+		}
+		if len(g.Proxies) < 2 {
+			log.Printf("relay group %s has less than 2 proxies, use select instead", g.Name)
+			proxyGroups[i].Type = "select"
+			continue
+		}
+		hops, err := chainHops(g, nodes, groups)
+		if err != nil {
+			log.Printf("keep relay group %s: %v", g.Name, err)
+			continue
+		}
+		prev := g.Proxies[0]
+		var exits []string
+		for _, members := range hops {
+			exits = nil
+			for _, node := range members {
+				node.Name = uniqueName(seen, node.Name+" ("+g.Name+")")
+				node.DialerProxy = prev
+				seen[node.Name] = true
+				proxies = append(proxies, node)
+				exits = append(exits, node.Name)
+			}
+			// 中间的跳只有一个节点
+			prev = exits[0]
+		}
+		proxyGroups[i] = ProxyGroup{Name: g.Name, Type: "select", Proxies: exits}
+	}
+	config.Proxies = proxies
+	config.ProxyGroups = proxyGroups
+	return config
+}
+
+// chainHops 返回relay分组第二跳起每一跳的节点, 最后一跳是分组时为其中的节点
+func chainHops(g ProxyGroup, nodes map[string]Node, groups map[string]ProxyGroup) ([][]Node, error) {
+	var hops [][]Node
+	for i, hop := range g.Proxies[1:] {
+		var members []Node
+		if node, ok := nodes[hop]; ok {
+			members = []Node{node}
+		} else if group, ok := groups[hop]; ok && i == len(g.Proxies)-2 {
+			for _, m := range group.Proxies {
+				if node, ok := nodes[m]; ok {
+					members = append(members, node)
+				}
+			}
+		}
+		if len(members) == 0 {
+			return nil, fmt.Errorf("cannot chain through %s", hop)
+		}
+		hops = append(hops, members)
+	}
+	return hops, nil
+}
+
+// checkChains 检查relay分组至少有两跳, dialer-proxy指向的节点或分组存在,
+// 且分组成员和dialer-proxy之间没有环路
+func checkChains(config ClashSub, names nameSet) error {
+	edges := make(map[string][]string)
+	for _, node := range config.Proxies {
+		if node.DialerProxy == "" {
+			continue
+		}
+		if !names.has(node.DialerProxy) {
+			return fmt.Errorf("node %s: unknown dialer-proxy %s", node.Name, node.DialerProxy)
+		}
+		edges[node.Name] = []string{node.DialerProxy}
+	}
+	for _, g := range config.ProxyGroups {
+		if g.Type == "relay" && len(g.Proxies) < 2 {
+			return fmt.Errorf("relay group %s: needs at least 2 proxies", g.Name)
+		}
+		edges[g.Name] = g.Proxies
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, p := range path {
+				if p == name {
+					return fmt.Errorf("proxy loop: %s", strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, next := range edges[name] {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		return nil
+	}
+	for _, node := range config.Proxies {
+		if err := visit(node.Name); err != nil {
+			return err
+		}
+	}
+	for _, g := range config.ProxyGroups {
+		if err := visit(g.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
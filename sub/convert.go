@@ -6,13 +6,10 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"regexp"
+	"sort"
 	"strings"
-	"time"
 
 	"github.com/biter777/countries"
-	"github.com/enescakir/emoji"
-	emojiflag "github.com/jayco/go-emoji-flag"
 	"gopkg.in/yaml.v3"
 )
 
@@ -28,57 +25,6 @@ const (
 	Optional
 )
 
-func availableOptionalCountries(remote ClashSub) (codes []countries.CountryCode) {
-	var countryGroupMap = make(map[countries.CountryCode][]Node)
-	for _, node := range remote.Proxies {
-		country := extractCountryFromNodeName(node.Name)
-		countryGroupMap[country] = append(countryGroupMap[country], node)
-	}
-
-	for _, c := range countriesNeeded {
-		// url-test or select? Though the need is rare, sometimes I want
-		// to use a specific node in the country
-		var proxies []string
-		for _, server := range countryGroupMap[c.CountryCode] {
-			proxies = append(proxies, server.Name)
-		}
-		if len(proxies) > 0 && c.priority == Optional {
-			codes = append(codes, c.CountryCode)
-		}
-	}
-	return
-}
-
-func urlTestGroup(name string, interval time.Duration, proxies ...string) ProxyGroup {
-	return ProxyGroup{
-		Name:     name,
-		Type:     "url-test",
-		URL:      "http://www.gstatic.com/generate_204",
-		Interval: int(interval.Seconds()),
-		//Tolerance: 0,
-		Proxies: proxies,
-	}
-}
-
-func selectGroup(name string, proxies ...string) ProxyGroup {
-	return ProxyGroup{
-		Name:    name,
-		Type:    "select",
-		Proxies: proxies,
-	}
-}
-
-func allNodes(remote ClashSub) ProxyGroup {
-	an := ProxyGroup{
-		Name: emoji.GlobeShowingAsiaAustralia.String() + "全部节点",
-		Type: "select",
-	}
-	for _, node := range remote.Proxies {
-		an.Proxies = append(an.Proxies, node.Name)
-	}
-	return an
-}
-
 func DomainRule(domain string, group ProxyGroup) Rule {
 	return Rule("DOMAIN," + domain + "," + group.Name)
 }
@@ -92,22 +38,111 @@ func DomainKeyWordRule(keyword string, group ProxyGroup) Rule {
 }
 
 type Node struct {
-	Name           string            `yaml:"name,omitempty"` // field needs to be modified
-	Type           string            `yaml:"type,omitempty"`
-	Server         string            `yaml:"server,omitempty"`
-	Port           string            `yaml:"port,omitempty"`
-	Cipher         string            `yaml:"cipher,omitempty"`
-	Password       string            `yaml:"password,omitempty"`
-	Protocol       string            `yaml:"protocol,omitempty"`
-	ProtocolParam  string            `yaml:"protocol-param,omitempty"`
-	Obfs           string            `yaml:"obfs,omitempty"`
-	ObfsParam      string            `yaml:"obfs-param,omitempty"`
+	Name           string         `yaml:"name,omitempty"` // field needs to be modified
+	Type           string         `yaml:"type,omitempty"`
+	Server         string         `yaml:"server,omitempty"`
+	Port           string         `yaml:"port,omitempty"`
+	Cipher         string         `yaml:"cipher,omitempty"`
+	Password       string         `yaml:"password,omitempty"`
+	Protocol       string         `yaml:"protocol,omitempty"`
+	ProtocolParam  string         `yaml:"protocol-param,omitempty"`
+	Obfs           string         `yaml:"obfs,omitempty"`
+	ObfsParam      string         `yaml:"obfs-param,omitempty"`
+	TLS            bool           `yaml:"tls,omitempty"`
+	SkipCertVerify bool           `yaml:"skip-cert-verify,omitempty"`
+	UDP            bool           `yaml:"udp,omitempty"`
+	Plugin         string         `yaml:"plugin,omitempty"`
+	PluginOpts     *PluginOptions `yaml:"plugin-opts,omitempty"`
+	TFO            bool           `yaml:"tfo,omitempty"`
+
+	// vmess
+	UUID       string       `yaml:"uuid,omitempty"`
+	AlterID    *int         `yaml:"alterId,omitempty"` // Clash要求vmess节点必须有alterId, 即使为0
+	ServerName string       `yaml:"servername,omitempty"`
+	Network    string       `yaml:"network,omitempty"` // tcp(默认) / ws / h2 / http / grpc
+	WSOpts     *WSOptions   `yaml:"ws-opts,omitempty"`
+	H2Opts     *H2Options   `yaml:"h2-opts,omitempty"`
+	HTTPOpts   *HTTPOptions `yaml:"http-opts,omitempty"`
+	GrpcOpts   *GrpcOptions `yaml:"grpc-opts,omitempty"`
+
+	// trojan, vmess使用servername而不是sni
+	SNI  string   `yaml:"sni,omitempty"`
+	ALPN []string `yaml:"alpn,omitempty"`
+
+	// vless, 以下字段仅Clash.Meta支持
+	Flow              string          `yaml:"flow,omitempty"`
+	ClientFingerprint string          `yaml:"client-fingerprint,omitempty"`
+	RealityOpts       *RealityOptions `yaml:"reality-opts,omitempty"`
+
+	// hysteria / hysteria2, 同样仅Clash.Meta支持
+	Ports        string `yaml:"ports,omitempty"` // 端口跳跃, 如"443,20000-30000"
+	AuthStr      string `yaml:"auth-str,omitempty"`
+	Up           string `yaml:"up,omitempty"`   // 上行带宽, 单位默认Mbps
+	Down         string `yaml:"down,omitempty"` // 下行带宽
+	ObfsPassword string `yaml:"obfs-password,omitempty"`
+
+	// tuic v5
+	CongestionController string `yaml:"congestion-controller,omitempty"`
+	UDPRelayMode         string `yaml:"udp-relay-mode,omitempty"`
+
+	// wireguard
+	PrivateKey   string `yaml:"private-key,omitempty"`
+	PublicKey    string `yaml:"public-key,omitempty"`
+	PreSharedKey string `yaml:"pre-shared-key,omitempty"`
+	IP           string `yaml:"ip,omitempty"`
+	IPv6         string `yaml:"ipv6,omitempty"`
+	Reserved     []int  `yaml:"reserved,omitempty,flow"`
+	MTU          int    `yaml:"mtu,omitempty"`
+
+	// 链式代理, 经由dialer-proxy指定的节点或分组连接本节点, 仅Clash.Meta支持
+	DialerProxy string `yaml:"dialer-proxy,omitempty"`
+
+	// 从节点名解析出的倍率等信息, 见AnnotateNodes
+	Meta *NodeMeta `yaml:"-"`
+}
+
+type RealityOptions struct {
+	PublicKey string `yaml:"public-key"`
+	ShortID   string `yaml:"short-id,omitempty"`
+}
+
+// PluginOptions ss插件参数, 不同插件使用其中不同的字段
+// obfs: mode, host
+// v2ray-plugin: mode, host, path, tls, mux, skip-cert-verify, headers
+// shadow-tls: host, password, version
+// restls: host, password, version-hint, restls-script
+type PluginOptions struct {
+	Mode           string            `yaml:"mode,omitempty"`
+	Host           string            `yaml:"host,omitempty"`
+	Path           string            `yaml:"path,omitempty"`
 	TLS            bool              `yaml:"tls,omitempty"`
+	Mux            *bool             `yaml:"mux,omitempty"` // Clash默认为true, 用指针区分未设置
 	SkipCertVerify bool              `yaml:"skip-cert-verify,omitempty"`
-	UDP            bool              `yaml:"udp,omitempty"`
-	Plugin         string            `yaml:"plugin,omitempty"`
-	PluginOpts     map[string]string `yaml:"plugin-opts,omitempty"`
-	TFO            bool              `yaml:"tfo,omitempty"`
+	Headers        map[string]string `yaml:"headers,omitempty"`
+	Password       string            `yaml:"password,omitempty"`
+	Version        int               `yaml:"version,omitempty"`
+	VersionHint    string            `yaml:"version-hint,omitempty"`
+	RestlsScript   string            `yaml:"restls-script,omitempty"`
+}
+
+type WSOptions struct {
+	Path    string            `yaml:"path,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+type H2Options struct {
+	Host []string `yaml:"host,omitempty"`
+	Path string   `yaml:"path,omitempty"`
+}
+
+type HTTPOptions struct {
+	Method  string              `yaml:"method,omitempty"`
+	Path    []string            `yaml:"path,omitempty"`
+	Headers map[string][]string `yaml:"headers,omitempty"`
+}
+
+type GrpcOptions struct {
+	GrpcServiceName string `yaml:"grpc-service-name,omitempty"`
 }
 
 type ProxyGroup struct {
@@ -117,8 +152,9 @@ type ProxyGroup struct {
 	Proxies   []string `yaml:"proxies"`
 	URL       string   `yaml:"url,omitempty"`
 	Tolerance int      `yaml:"tolerance,omitempty"`
-	Lazy      bool     `yaml:"lazy,omitempty"`
+	Lazy      *bool    `yaml:"lazy,omitempty"` // nil时不输出, 使用Clash的默认值
 	Interval  int      `yaml:"interval,omitempty"`
+	Strategy  string   `yaml:"strategy,omitempty"` // load-balance: consistent-hashing, round-robin
 }
 
 type RuleProvider struct {
@@ -204,26 +240,8 @@ type DNSSetting struct {
 	IPv6         bool     `yaml:"ipv6"` //  when the false, response to AAAA questions will be empty
 }
 
-type RuleSetTreatment func(r RuleProvider) RuleProvider
-
 func extractCountryFromNodeName(node string) countries.CountryCode {
-	if anyTwoCharCode.MatchString(node) {
-		return countries.ByName(anyTwoCharCode.FindStringSubmatch(node)[1])
-	} else if code := chineseMatch(node); code != "" {
-		return countries.ByName(code)
-	}
-	log.Printf("cannot match country code: %s", node)
-	return countries.Unknown
-}
-
-// Clash规则
-// https://github.com/Loyalsoldier/clash-rules
-func loyalSoldierClashRules(key string) RuleProvider {
-	return RuleProvider{
-		Type: "http",
-		URL:  "https://cdn.jsdelivr.net/gh/Loyalsoldier/clash-rules@release/" + key + ".txt",
-		Path: "./ruleset/" + key + ".yaml",
-	}
+	return defaultGeoMatcher.locateOrLog(Node{Name: node})
 }
 
 func newHttpClient(proxyEnv bool) *http.Client {
@@ -243,9 +261,9 @@ var proxyClient = newHttpClient(true)
 
 // Clash规则碎片
 // https://github.com/ACL4SSR/ACL4SSR
-// 读取ACL4SSR/ACL4SSR仓库的规则碎片，转换为匹配策略key的Rule
+// 读取ACL4SSR/ACL4SSR仓库的规则碎片，转换为匹配策略groupName的Rule
 // 对github内容的访问本身需要代理
-func acl4ssrClashRules(key string, emojiPrefix emoji.Emoji) []Rule {
+func acl4ssrClashRules(key string, groupName string) []Rule {
 	res, err := proxyClient.Get("https://raw.githubusercontent.com/ACL4SSR/ACL4SSR/master/Clash/Ruleset/" + key + ".list")
 	if err != nil {
 		return nil
@@ -253,7 +271,6 @@ func acl4ssrClashRules(key string, emojiPrefix emoji.Emoji) []Rule {
 	scanner := bufio.NewScanner(res.Body)
 	var rules []Rule
 	defer res.Body.Close()
-	groupName := emojiPrefix.String() + key
 	for scanner.Scan() {
 		line := scanner.Text()
 		switch {
@@ -269,47 +286,10 @@ func acl4ssrClashRules(key string, emojiPrefix emoji.Emoji) []Rule {
 	return rules
 }
 
-// See: https://github.com/Semporia/ClashX-Pro
-// Must provide a valid key, or rules are corrupted
-func semporiaClashXRules(key string) RuleProvider {
-	return RuleProvider{
-		Type:     "http",
-		Behavior: "classical",
-		Path:     "./ruleset/" + strings.ToLower(key) + ".yaml",
-		URL:      "https://raw.githubusercontent.com/Semporia/Clash/master/Rule/" + key + ".yaml",
-	}
-}
-
-func Domain(r RuleProvider) RuleProvider {
-	nr := r
-	nr.Behavior = "domain"
-	return nr
-}
-
-func IPCIRD(r RuleProvider) RuleProvider {
-	nr := r
-	nr.Behavior = "ipcidr"
-	return nr
-}
-
 func countryGroup(c countries.CountryCode) string {
 	return c.Emoji() + c.Alpha2()
 }
 
-func mediaGroup(key string, emojiPrefix emoji.Emoji, countries ...countries.CountryCode) ProxyGroup {
-	pg := ProxyGroup{
-		Name: emojiPrefix.String() + key,
-		Type: "select",
-		Proxies: []string{
-			DIRECT,
-		},
-	}
-	for i := range countries {
-		pg.Proxies = append(pg.Proxies, countryGroup(countries[i]))
-	}
-	return pg
-}
-
 func decodeClashConfig(res *http.Response) (ClashSub, error) {
 	var remote ClashSub
 	err := yaml.NewDecoder(res.Body).Decode(&remote)
@@ -351,6 +331,11 @@ func AddHosts(records DNSMapping) Processor {
 }
 
 func Pass(remote ClashSub, out io.Writer, proc ...Processor) error {
+	return RenderClash(PassConfig(remote, proc...), out)
+}
+
+// PassConfig 保留上游的分组和规则, 只替换NewSub中的全局设置
+func PassConfig(remote ClashSub, proc ...Processor) ClashSub {
 	config := NewSub()
 	config.Proxies = remote.Proxies
 	config.ProxyProviders = remote.ProxyProviders
@@ -360,175 +345,59 @@ func Pass(remote ClashSub, out io.Writer, proc ...Processor) error {
 	for i := range proc {
 		proc[i](&config)
 	}
+	return config
+}
+
+// RenderClash 输出Clash YAML配置
+func RenderClash(config ClashSub, out io.Writer) error {
 	encoder := yaml.NewEncoder(out)
 	encoder.SetIndent(2)
 	return encoder.Encode(&config)
 }
 
-// 按国家分组
-func groupByCountries(remote ClashSub, gr *ProxyGroup, dealWithEmptyGroup string) (countryGroups []ProxyGroup) {
+// 按国家分组, 返回生成的国家分组以及国家到分组名的映射
+func groupByCountries(remote ClashSub, geo *GeoMatcher, needed []countryNeed, dealWithEmptyGroup string) (countryGroups []ProxyGroup, names map[countries.CountryCode]string) {
 	var countryGroupMap = make(map[countries.CountryCode][]Node)
 	for _, node := range remote.Proxies {
-		country := extractCountryFromNodeName(node.Name)
+		country := geo.locateOrLog(node)
 		countryGroupMap[country] = append(countryGroupMap[country], node)
 	}
 
-	for _, c := range countriesNeeded {
-		// url-test or select? Though the need is rare, sometimes I want
-		// to use a specific node in the country
-		group := selectGroup(countryGroup(c.CountryCode))
+	// 国家分组内按倍率从低到高排列, 倍率相同的保持原顺序
+	for _, nodes := range countryGroupMap {
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].Metadata().Multiplier < nodes[j].Metadata().Multiplier
+		})
+	}
+
+	names = make(map[countries.CountryCode]string)
+	for _, c := range needed {
+		var members []string
 		for _, server := range countryGroupMap[c.CountryCode] {
-			group.Proxies = append(group.Proxies, server.Name)
+			members = append(members, server.Name)
 		}
-		if len(group.Proxies) == 0 {
+		if len(members) == 0 {
 			if dealWithEmptyGroup == "placeholder" || c.priority == Required {
-				log.Printf("no nodes matched for country %s, put a DIRECT here", c)
-				group.Proxies = []string{DIRECT}
+				log.Printf("no nodes matched for country %s, put a DIRECT here", c.CountryCode)
+				members = []string{DIRECT}
 			} else if dealWithEmptyGroup == "drop" && c.priority == Optional {
 				continue
 			}
 		}
-		countryGroups = append(countryGroups, group)
-		gr.Proxies = append(gr.Proxies, group.Name)
+		// 分组类型见GroupStrategy, 缺省为select, 便于手动选择国家内的节点
+		countryGroups = append(countryGroups, c.strategy.groups(c.name, members)...)
+		names[c.CountryCode] = c.name
 	}
 	return
 }
 
 func Rewrite(remote ClashSub, out io.Writer, emptyPolicy string, ruleStreamMedia bool, proc ...Processor) error {
-	// since 20220921, TAG node names alreay have emoji prefix
-	// no prefixEmoji needed
-
-	/* PROXY GROUPS */
-	gr := grand()
-	an := allNodes(remote)
-	if emptyPolicy == "" {
-		emptyPolicy = "drop"
-	}
-	countryGroups := groupByCountries(remote, &gr, emptyPolicy)
-	gr.Proxies = append(gr.Proxies, an.Name, selfHosted.Name)
-
-	// The order of groups
-	proxyGroups := []ProxyGroup{
-		gr,
-		an,
-		reject,
-		rest,
-		minecraft,
-		apple,
-		embyUnlock,
-		embyTagNewFlavor,
-		telegram,
-		switchGroup,
-		openAIGroup,
-		github,
-		microsoft,
-		steam,
-		youtube,
-		amazon,
-		proxyConverter,
-		ipCheck,
-		selfHosted,
-		xiaohongshu,
-		reddit,
-		zhihu,
-		qq,
-		spotify,
-	}
-
-	/* RULES */
-	var rules []Rule
-
-	for _, x := range [][]Rule{
-		RulesNintendo,
-		RulesOpenAI,
-		RulesEmby,
-		RulesProxyConverterRules,
-		RulesSpecial,
-		RulesMinecraft,
-		RulesXiaohongshu,
-		RulesReddit,
-		RulesZhihu,
-		RulesQQ,
-		RulesSpotify,
-	} {
-		rules = append(rules, x...)
-	}
-
-	/* 流媒体 */
-	// could be slow if server cannot access Github properly
-	if ruleStreamMedia {
-		var (
-			streamingEmoji = emoji.Television
-		)
-		for _, x := range streamMedia {
-			proxyGroups = append(proxyGroups, mediaGroup(x.mediaKey, streamingEmoji, x.countries...))
-			moreRules := acl4ssrClashRules(x.mediaKey, streamingEmoji)
-			rules = append(rules, moreRules...)
-		}
-	}
-
-	proxyGroups = append(proxyGroups, countryGroups...)
-
-	/* RULE PROVIDERS */
-	ruleProviders := map[string]RuleProvider{
-		"microsoft": semporiaClashXRules("Microsoft"),
-		"github":    semporiaClashXRules("GitHub"),
-		"steam":     semporiaClashXRules("Steam"),
-		"youtube":   semporiaClashXRules("YouTube"),
-		"amazon":    semporiaClashXRules("Amazon"),
-	}
-	rules = append(rules,
-		Rule("RULE-SET,microsoft,"+microsoft.Name),
-		Rule("RULE-SET,github,"+github.Name),
-		Rule("RULE-SET,steam,"+steam.Name),
-		Rule("RULE-SET,youtube,"+youtube.Name),
-		Rule("RULE-SET,amazon,"+amazon.Name),
-	)
-
-	for _, x := range []struct {
-		Treatment RuleSetTreatment
-		RuleSet   string
-		Chain     string // ignore this ruleset if left empty, add it though
-	}{
-		{Treatment: Domain, RuleSet: "reject", Chain: reject.Name},
-		{Treatment: Domain, RuleSet: "icloud", Chain: DIRECT},
-		{Treatment: Domain, RuleSet: "apple", Chain: apple.Name},
-		{Treatment: Domain, RuleSet: "google", Chain: DIRECT},
-		{Treatment: Domain, RuleSet: "proxy", Chain: grand().Name},
-		{Treatment: Domain, RuleSet: "direct", Chain: DIRECT},
-		{Treatment: Domain, RuleSet: "private", Chain: DIRECT},
-		{Treatment: Domain, RuleSet: "gfw"},
-		{Treatment: Domain, RuleSet: "greatfire"},
-		{Treatment: Domain, RuleSet: "tld-not-cn"},
-
-		{Treatment: IPCIRD, RuleSet: "telegramcidr", Chain: telegram.Name},
-		{Treatment: IPCIRD, RuleSet: "cncidr"},
-		{Treatment: IPCIRD, RuleSet: "lancidr"},
-	} {
-		ruleProviders[x.RuleSet] = x.Treatment(loyalSoldierClashRules(x.RuleSet))
-		// 白名单模式
-		if x.Chain != "" {
-			rules = append(rules, Rule("RULE-SET"+","+x.RuleSet+","+x.Chain))
-		}
-	}
-	// 白名单模式
-	rules = append(rules, "GEOIP,CN,DIRECT")
-
-	config := NewSub()
-	config.ProxyGroups = proxyGroups
-	config.Rules = rules
-	config.Proxies = append(remote.Proxies, userDefinedNodes...)
-	config.RuleProviders = ruleProviders
-
-	for i := range proc {
-		proc[i](&config)
-	}
+	return RenderClash(RewriteConfig(remote, emptyPolicy, ruleStreamMedia, proc...), out)
+}
 
-	// 漏网之鱼
-	config.Rules = append(config.Rules, Rule("MATCH,"+rest.Name))
-	encoder := yaml.NewEncoder(out)
-	encoder.SetIndent(2)
-	return encoder.Encode(&config)
+// RewriteConfig 按内置布局重新分组并加上自定义的分组和规则, 返回内存中的配置供各种格式输出
+func RewriteConfig(remote ClashSub, emptyPolicy string, ruleStreamMedia bool, proc ...Processor) ClashSub {
+	return DefaultTemplate().Rewrite(remote, emptyPolicy, ruleStreamMedia, proc...)
 }
 
 // NewSub creates a default config
@@ -558,37 +427,3 @@ func NewSub() ClashSub {
 		},
 	}
 }
-
-var anyTwoCharCode = regexp.MustCompile(".*([A-Za-z]{2})")
-
-// brutal way to recognize geo names in chinese
-var chineseCodeMap = map[string]string{
-	"台湾": "TW",
-	"日本": "JP",
-	"狮城": "SG",
-	"美国": "US",
-	"香港": "HK",
-}
-
-func chineseMatch(name string) string {
-	for ch, code := range chineseCodeMap {
-		if strings.Contains(name, ch) {
-			return code
-		}
-	}
-	return ""
-}
-
-func prefixEmoji(sub *ClashSub) {
-	for i := range sub.Proxies {
-		name := sub.Proxies[i].Name
-		var countryCode string
-		if anyTwoCharCode.MatchString(name) {
-			countryCode = anyTwoCharCode.FindStringSubmatch(name)[1]
-		} else {
-			log.Printf("cannot match country code: %s", name)
-			continue
-		}
-		sub.Proxies[i].Name = emojiflag.GetFlag(countryCode) + name
-	}
-}
@@ -0,0 +1,58 @@
+package sub
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// nodeKey 节点的连接参数, 名称和udp, tfo, skip-cert-verify等开关不影响是否为同一节点
+func nodeKey(node Node) string {
+	node.Name = ""
+	node.Server = strings.ToLower(node.Server)
+	node.UDP = false
+	node.TFO = false
+	node.SkipCertVerify = false
+	b, err := yaml.Marshal(&node)
+	if err != nil {
+		return node.Type + "://" + node.Server + ":" + node.Port
+	}
+	return string(b)
+}
+
+// DedupNodes 去掉连接参数相同的重复节点, 保留第一个的名称, 返回去重后的副本和被去掉的节点名
+// proxy-groups和规则中对被去掉节点的引用改为保留的节点, 剩下的重名节点追加序号, Clash不允许重名
+func DedupNodes(remote ClashSub) (ClashSub, []string) {
+	var (
+		proxies []Node
+		dropped []string
+		kept    = make(map[string]string) // nodeKey -> 保留的节点名
+		renamed = make(map[string]string)
+		seen    = make(map[string]bool)
+	)
+	for _, node := range remote.Proxies {
+		key := nodeKey(node)
+		if name, ok := kept[key]; ok {
+			dropped = append(dropped, node.Name)
+			if node.Name != name {
+				renamed[node.Name] = name
+			}
+			continue
+		}
+		node.Name = uniqueName(seen, node.Name)
+		seen[node.Name] = true
+		kept[key] = node.Name
+		proxies = append(proxies, node)
+	}
+	remote.Proxies = proxies
+	// 被去掉的节点与保留的节点同名时, 引用指向的是保留的节点, 不能改
+	for name := range renamed {
+		if seen[name] {
+			delete(renamed, name)
+		}
+	}
+	if len(renamed) > 0 {
+		renameReferences(&remote, renamed)
+	}
+	return remote, dropped
+}
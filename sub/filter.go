@@ -0,0 +1,159 @@
+package sub
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/biter777/countries"
+)
+
+// NodeFilter 在按国家分组之前过滤节点, 去掉"剩余流量", "官网"之类的占位节点
+//
+// 每一项为"字段:正则"或"multiplier比较", 不带字段时匹配节点名:
+//
+//	剩余流量|官网       节点名匹配
+//	type:ssr|http      类型匹配
+//	server:example     服务器地址匹配
+//	port:^443$         端口匹配
+//	country:HK|JP      识别到的国家代码匹配
+//	line:IPLC|IEPL     线路类型匹配, 见NodeMeta
+//	isp:电信            运营商匹配
+//	multiplier>1.5     倍率比较, 支持<, <=, >, >=, =
+//
+// 节点必须满足全部include, 满足任一exclude即被去掉
+type NodeFilter struct {
+	include []filterTerm
+	exclude []filterTerm
+}
+
+type filterTerm struct {
+	expr    string
+	field   string
+	pattern *regexp.Regexp
+	// multiplier
+	op    string
+	value float64
+}
+
+var (
+	filterFields      = []string{"name", "type", "server", "port", "country", "line", "isp"}
+	multiplierPattern = regexp.MustCompile(`^multiplier\s*(<=|>=|<|>|=)\s*(\d+(?:\.\d+)?)$`)
+)
+
+// ParseNodeFilter 解析include和exclude表达式, 均为空时返回nil
+func ParseNodeFilter(include, exclude []string) (*NodeFilter, error) {
+	var (
+		f   NodeFilter
+		err error
+	)
+	if f.include, err = parseFilterTerms(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = parseFilterTerms(exclude); err != nil {
+		return nil, err
+	}
+	if len(f.include) == 0 && len(f.exclude) == 0 {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+func parseFilterTerms(exprs []string) ([]filterTerm, error) {
+	var terms []filterTerm
+	for _, expr := range exprs {
+		expr = strings.TrimSpace(expr)
+		if expr == "" {
+			continue
+		}
+		term := filterTerm{expr: expr, field: "name"}
+		if match := multiplierPattern.FindStringSubmatch(expr); match != nil {
+			term.field, term.op = "multiplier", match[1]
+			term.value, _ = strconv.ParseFloat(match[2], 64)
+			terms = append(terms, term)
+			continue
+		}
+		pattern := expr
+		if field, rest, ok := strings.Cut(expr, ":"); ok && contains(filterFields, field) {
+			term.field, pattern = field, rest
+		}
+		var err error
+		if term.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("filter %q: %w", expr, err)
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+func contains(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (t filterTerm) match(node Node, geo *GeoMatcher) bool {
+	var value string
+	switch t.field {
+	case "multiplier":
+		m := node.Metadata().Multiplier
+		switch t.op {
+		case "<":
+			return m < t.value
+		case "<=":
+			return m <= t.value
+		case ">":
+			return m > t.value
+		case ">=":
+			return m >= t.value
+		default:
+			return m == t.value
+		}
+	case "type":
+		value = node.Type
+	case "server":
+		value = node.Server
+	case "port":
+		value = node.Port
+	case "line":
+		value = node.Metadata().LineType
+	case "isp":
+		value = node.Metadata().ISP
+	case "country":
+		if c, _ := geo.Locate(node); c != countries.Unknown {
+			value = c.Alpha2()
+		}
+	default:
+		value = node.Name
+	}
+	return t.pattern.MatchString(value)
+}
+
+// Apply 返回通过过滤的节点, f为nil时原样返回
+func (f *NodeFilter) Apply(nodes []Node, geo *GeoMatcher) []Node {
+	if f == nil {
+		return nodes
+	}
+	var out []Node
+next:
+	for _, node := range nodes {
+		for _, t := range f.include {
+			if !t.match(node, geo) {
+				continue next
+			}
+		}
+		for _, t := range f.exclude {
+			if t.match(node, geo) {
+				log.Printf("filter out %s by %q", node.Name, t.expr)
+				continue next
+			}
+		}
+		out = append(out, node)
+	}
+	return out
+}
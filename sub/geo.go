@@ -0,0 +1,320 @@
+package sub
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/biter777/countries"
+)
+
+// GeoOverride 用户自定义的匹配规则, 节点名匹配Pattern时直接归为Country, 优先于内置规则
+type GeoOverride struct {
+	Pattern string `yaml:"pattern"` // 正则, 如"(?i)netflix-sg"
+	Country string `yaml:"country"` // ISO 3166-1 alpha-2
+}
+
+type geoOverride struct {
+	pattern *regexp.Regexp
+	country countries.CountryCode
+}
+
+// GeoMatcher 从节点名识别国家, 依次尝试:
+// 用户规则, 国旗emoji, 中文国名和城市名, 英文国名和城市名, 大写的IATA机场代码, alpha-3和alpha-2代码,
+// 最后是GeoIP(如果启用)
+type GeoMatcher struct {
+	overrides []geoOverride
+}
+
+func NewGeoMatcher(overrides []GeoOverride) (*GeoMatcher, error) {
+	m := &GeoMatcher{}
+	for _, o := range overrides {
+		pattern, err := regexp.Compile(o.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("geo override %q: %w", o.Pattern, err)
+		}
+		if !validCountry(o.Country) {
+			return nil, fmt.Errorf("geo override %q: unknown country %q", o.Pattern, o.Country)
+		}
+		m.overrides = append(m.overrides, geoOverride{pattern, countries.ByName(o.Country)})
+	}
+	return m, nil
+}
+
+var defaultGeoMatcher = &GeoMatcher{}
+
+// Match 返回节点名对应的国家, 无法识别时返回countries.Unknown
+func (m *GeoMatcher) Match(name string) countries.CountryCode {
+	c, _ := m.Locate(Node{Name: name})
+	return c
+}
+
+// Locate 返回节点所在的国家及识别来源, 节点名无法识别且启用了GeoIP时按服务器地址查询
+// 重命名过的节点使用改名前识别到的结果
+func (m *GeoMatcher) Locate(node Node) (countries.CountryCode, GeoSource) {
+	if node.Meta != nil && node.Meta.located {
+		return node.Meta.Country, node.Meta.GeoSource
+	}
+	for _, o := range m.overrides {
+		if o.pattern.MatchString(node.Name) {
+			return o.country, GeoSourceOverride
+		}
+	}
+	for _, match := range []func(string) countries.CountryCode{
+		matchFlag,
+		matchChinese,
+		matchEnglish,
+		matchToken,
+	} {
+		if c := match(node.Name); c != countries.Unknown {
+			return c, GeoSourceName
+		}
+	}
+	if geoIP != nil && node.Server != "" {
+		c, err := geoIP.Lookup(node.Server)
+		if err != nil {
+			log.Printf("geoip lookup %s: %v", node.Server, err)
+		} else if c != countries.Unknown {
+			return c, GeoSourceIP
+		}
+	}
+	return countries.Unknown, GeoSourceNone
+}
+
+func (m *GeoMatcher) locateOrLog(node Node) countries.CountryCode {
+	c, source := m.Locate(node)
+	switch source {
+	case GeoSourceNone:
+		log.Printf("cannot match country code: %s", node.Name)
+	case GeoSourceIP:
+		log.Printf("match country code by geoip: %s (%s) -> %s", node.Name, node.Server, c.Alpha2())
+	}
+	return c
+}
+
+// matchFlag 国旗emoji由两个区域指示符组成, 对应alpha-2代码
+func matchFlag(name string) countries.CountryCode {
+	runes := []rune(name)
+	for i := 0; i+1 < len(runes); i++ {
+		if !isRegionalIndicator(runes[i]) || !isRegionalIndicator(runes[i+1]) {
+			continue
+		}
+		code := string([]rune{runes[i] - 0x1F1E6 + 'A', runes[i+1] - 0x1F1E6 + 'A'})
+		if c := alpha2(code); c != countries.Unknown {
+			return c
+		}
+		i++
+	}
+	return countries.Unknown
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// matchChinese 中文没有词边界, 按子串匹配, 同一位置取最长的
+// "中国"只在没有其他匹配时才算, 避免"中国香港"被归为CN
+func matchChinese(name string) countries.CountryCode {
+	fallback := countries.Unknown
+	for _, key := range chinesePattern.FindAllString(name, -1) {
+		if c := countries.ByName(chineseNames[key]); c != countries.CN {
+			return c
+		}
+		fallback = countries.CN
+	}
+	return fallback
+}
+
+// matchEnglish 英文国名和城市名, 忽略大小写, 必须在词边界上
+func matchEnglish(name string) countries.CountryCode {
+	if match := englishPattern.FindStringSubmatch(name); match != nil {
+		return countries.ByName(englishNames[strings.ToLower(match[1])])
+	}
+	return countries.Unknown
+}
+
+var (
+	tokenPattern = regexp.MustCompile(`[A-Za-z0-9]+`)
+	// geoStopwords 线路类型等常见的大写缩写, 不作为国家代码
+	geoStopwords = map[string]bool{
+		"CN2": true, "GIA": true, "IPLC": true, "IEPL": true, "BGP": true, "CDN": true,
+		"NF": true, "AI": true, "GPT": true, "TV": true, "ME": true, "VIP": true,
+		"UDP": true, "TCP": true, "SS": true, "SSR": true, "TLS": true,
+	}
+)
+
+// matchToken 按字母数字切分, 去掉代码后面的编号(如HK01)后取全大写的2位或3位代码
+// 以数字开头的不算, 如100GB是流量而不是英国
+// 3位时IATA机场代码优先于alpha-3, 如FRA为法兰克福而不是法国
+// 没有全大写的代码时, lowercaseCodes中唯一一个小写代码也算, 如"hk 01"
+func matchToken(name string) countries.CountryCode {
+	var lower []countries.CountryCode
+	for _, token := range tokenPattern.FindAllString(name, -1) {
+		if geoStopwords[token] || token[0] >= '0' && token[0] <= '9' {
+			continue
+		}
+		token = strings.TrimRight(token, "0123456789")
+		if geoStopwords[token] || strings.ContainsAny(token, "0123456789") {
+			continue
+		}
+		if token != strings.ToUpper(token) {
+			if c, ok := lowercaseCodes[token]; ok {
+				lower = append(lower, countries.ByName(c))
+			}
+			continue
+		}
+		switch len(token) {
+		case 2:
+			if c := alpha2(token); c != countries.Unknown {
+				return c
+			}
+		case 3:
+			if code, ok := iataCodes[token]; ok {
+				return countries.ByName(code)
+			}
+			if c := countries.ByName(token); c != countries.Unknown && c.Alpha3() == token {
+				return c
+			}
+		}
+	}
+	if len(lower) == 1 {
+		return lower[0]
+	}
+	return countries.Unknown
+}
+
+// lowercaseCodes 机场常用的小写国家代码, 其他小写的两个字母多为单词, 如by, my, in, it
+var lowercaseCodes = map[string]string{
+	"hk": "HK", "tw": "TW", "mo": "MO", "jp": "JP", "sg": "SG", "kr": "KR", "us": "US", "uk": "GB",
+}
+
+func alpha2(code string) countries.CountryCode {
+	switch code {
+	case "UK":
+		return countries.GB
+	}
+	if c := countries.ByName(code); c != countries.Unknown && c.Alpha2() == code {
+		return c
+	}
+	return countries.Unknown
+}
+
+// chineseNames 中文国名, 简称和城市名
+var chineseNames = map[string]string{
+	"香港": "HK", "深港": "HK", "沪港": "HK", "京港": "HK", "广港": "HK",
+	"澳门": "MO",
+	"台湾": "TW", "台北": "TW", "新北": "TW", "台中": "TW", "高雄": "TW", "彰化": "TW",
+	"日本": "JP", "东京": "JP", "大阪": "JP", "埼玉": "JP", "名古屋": "JP", "福冈": "JP", "川日": "JP", "沪日": "JP",
+	"新加坡": "SG", "狮城": "SG",
+	"美国": "US", "洛杉矶": "US", "圣何塞": "US", "硅谷": "US", "西雅图": "US", "芝加哥": "US", "纽约": "US",
+	"达拉斯": "US", "凤凰城": "US", "波特兰": "US", "迈阿密": "US", "费利蒙": "US", "弗里蒙特": "US",
+	"拉斯维加斯": "US", "亚特兰大": "US", "底特律": "US", "华盛顿": "US", "旧金山": "US", "俄勒冈": "US",
+	"韩国": "KR", "首尔": "KR", "春川": "KR", "釜山": "KR",
+	"英国": "GB", "伦敦": "GB", "曼彻斯特": "GB",
+	"法国": "FR", "巴黎": "FR", "马赛": "FR",
+	"德国": "DE", "法兰克福": "DE", "柏林": "DE", "慕尼黑": "DE",
+	"荷兰": "NL", "阿姆斯特丹": "NL",
+	"泰国": "TH", "曼谷": "TH",
+	"冰岛":  "IS",
+	"俄罗斯": "RU", "莫斯科": "RU", "伯力": "RU", "圣彼得堡": "RU",
+	"印度": "IN", "孟买": "IN",
+	"印尼": "ID", "印度尼西亚": "ID", "雅加达": "ID",
+	"马来西亚": "MY", "吉隆坡": "MY",
+	"菲律宾": "PH", "马尼拉": "PH",
+	"越南": "VN", "胡志明": "VN", "河内": "VN",
+	"澳大利亚": "AU", "澳洲": "AU", "悉尼": "AU", "墨尔本": "AU",
+	"新西兰": "NZ", "奥克兰": "NZ",
+	"加拿大": "CA", "多伦多": "CA", "温哥华": "CA", "蒙特利尔": "CA",
+	"土耳其": "TR", "伊斯坦布尔": "TR",
+	"阿联酋": "AE", "迪拜": "AE",
+	"以色列": "IL",
+	"意大利": "IT", "米兰": "IT",
+	"西班牙": "ES", "马德里": "ES",
+	"瑞士": "CH", "苏黎世": "CH",
+	"瑞典": "SE", "斯德哥尔摩": "SE",
+	"芬兰": "FI", "挪威": "NO", "丹麦": "DK", "爱尔兰": "IE", "都柏林": "IE",
+	"波兰": "PL", "乌克兰": "UA", "奥地利": "AT", "比利时": "BE", "葡萄牙": "PT",
+	"巴西": "BR", "圣保罗": "BR", "阿根廷": "AR", "智利": "CL", "墨西哥": "MX",
+	"南非": "ZA", "埃及": "EG", "尼日利亚": "NG",
+	"哈萨克斯坦": "KZ", "蒙古": "MN", "柬埔寨": "KH", "缅甸": "MM", "巴基斯坦": "PK",
+	"中国": "CN", "回国": "CN",
+}
+
+// englishNames 英文国名和城市名, key为小写
+var englishNames = map[string]string{
+	"hong kong": "HK", "hongkong": "HK",
+	"macau": "MO", "macao": "MO",
+	"taiwan": "TW", "taipei": "TW",
+	"japan": "JP", "tokyo": "JP", "osaka": "JP", "saitama": "JP",
+	"singapore":     "SG",
+	"united states": "US", "america": "US", "los angeles": "US", "san jose": "US", "silicon valley": "US",
+	"seattle": "US", "chicago": "US", "new york": "US", "dallas": "US", "phoenix": "US", "portland": "US",
+	"miami": "US", "fremont": "US", "las vegas": "US", "atlanta": "US", "detroit": "US", "san francisco": "US",
+	"korea": "KR", "south korea": "KR", "seoul": "KR", "chuncheon": "KR",
+	"united kingdom": "GB", "britain": "GB", "england": "GB", "london": "GB",
+	"france": "FR", "paris": "FR", "marseille": "FR",
+	"germany": "DE", "frankfurt": "DE", "berlin": "DE",
+	"netherlands": "NL", "amsterdam": "NL",
+	"thailand": "TH", "bangkok": "TH",
+	"iceland": "IS",
+	"russia":  "RU", "moscow": "RU", "khabarovsk": "RU",
+	"india": "IN", "mumbai": "IN",
+	"indonesia": "ID", "jakarta": "ID",
+	"malaysia": "MY", "kuala lumpur": "MY",
+	"philippines": "PH", "manila": "PH",
+	"vietnam":   "VN",
+	"australia": "AU", "sydney": "AU", "melbourne": "AU",
+	"canada": "CA", "toronto": "CA", "vancouver": "CA",
+	"turkey": "TR", "istanbul": "TR",
+	"dubai": "AE", "israel": "IL", "italy": "IT", "milan": "IT", "spain": "ES", "madrid": "ES",
+	"switzerland": "CH", "zurich": "CH", "sweden": "SE", "stockholm": "SE", "ireland": "IE", "dublin": "IE",
+	"brazil": "BR", "sao paulo": "BR", "argentina": "AR", "mexico": "MX",
+}
+
+// iataCodes 主要机场的IATA代码, 机场命名的订阅常用
+var iataCodes = map[string]string{
+	"HKG": "HK", "MFM": "MO",
+	"TPE": "TW", "TSA": "TW", "KHH": "TW",
+	"NRT": "JP", "HND": "JP", "KIX": "JP", "ITM": "JP", "NGO": "JP", "FUK": "JP", "CTS": "JP",
+	"SIN": "SG",
+	"LAX": "US", "SJC": "US", "SFO": "US", "SEA": "US", "ORD": "US", "JFK": "US", "EWR": "US", "IAD": "US",
+	"ATL": "US", "DFW": "US", "MIA": "US", "PDX": "US", "DEN": "US", "BOS": "US", "LAS": "US", "PHX": "US",
+	"ICN": "KR", "GMP": "KR", "PUS": "KR",
+	"LHR": "GB", "LGW": "GB", "MAN": "GB",
+	"CDG": "FR", "ORY": "FR",
+	"FRA": "DE", "MUC": "DE", "BER": "DE", "TXL": "DE",
+	"AMS": "NL",
+	"BKK": "TH", "DMK": "TH",
+	"KEF": "IS",
+	"SVO": "RU", "DME": "RU", "LED": "RU", "KHV": "RU",
+	"BOM": "IN", "DEL": "IN",
+	"CGK": "ID", "KUL": "MY", "MNL": "PH", "SGN": "VN", "HAN": "VN",
+	"SYD": "AU", "MEL": "AU", "AKL": "NZ",
+	"YVR": "CA", "YYZ": "CA", "YUL": "CA",
+	"IST": "TR", "DXB": "AE", "TLV": "IL",
+	"MXP": "IT", "FCO": "IT", "MAD": "ES", "ZRH": "CH", "ARN": "SE", "HEL": "FI", "DUB": "IE", "WAW": "PL",
+	"GRU": "BR", "EZE": "AR", "SCL": "CL", "MEX": "MX", "JNB": "ZA",
+}
+
+var (
+	chinesePattern = keywordPattern(chineseNames, "", "")
+	// 数字不算词的一部分, 以匹配Tokyo01这样的写法
+	englishPattern = keywordPattern(englishNames, `(?i)(?:^|[^a-z])`, `(?:[^a-z]|$)`)
+)
+
+// keywordPattern 把关键词拼成一个正则, 关键词为第一个分组, 长的在前, 使同一位置取最长的匹配
+func keywordPattern(names map[string]string, prefix, suffix string) *regexp.Regexp {
+	var keys []string
+	for key := range names {
+		keys = append(keys, regexp.QuoteMeta(key))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	return regexp.MustCompile(prefix + "(" + strings.Join(keys, "|") + ")" + suffix)
+}
@@ -0,0 +1,144 @@
+package sub
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/biter777/countries"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoSource 节点国家的识别来源
+type GeoSource string
+
+const (
+	GeoSourceNone     GeoSource = ""         // 未识别
+	GeoSourceOverride GeoSource = "override" // 用户规则
+	GeoSourceName     GeoSource = "name"     // 节点名
+	GeoSourceIP       GeoSource = "geoip"    // 服务器地址查询MMDB
+)
+
+// GeoIP 用离线的MMDB(MaxMind GeoLite2-Country/City格式)按服务器地址识别国家
+// 域名先经resolver解析, 结果在进程内缓存
+type GeoIP struct {
+	db       *maxminddb.Reader
+	resolver *net.Resolver
+	timeout  time.Duration
+
+	mu    sync.Mutex
+	cache map[string]geoIPEntry
+}
+
+type geoIPEntry struct {
+	country countries.CountryCode
+	err     error
+	expire  time.Time
+}
+
+const (
+	geoIPCacheTTL = time.Hour
+	// 解析失败的地址也缓存, 以免每次请求都等待DNS超时
+	geoIPFailureTTL = 5 * time.Minute
+)
+
+// OpenGeoIP 打开MMDB文件, resolver为DNS服务器地址(如223.5.5.5:53), 为空时使用系统的解析
+func OpenGeoIP(path string, resolver string) (*GeoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &GeoIP{
+		db:       db,
+		resolver: net.DefaultResolver,
+		timeout:  3 * time.Second,
+		cache:    make(map[string]geoIPEntry),
+	}
+	if resolver != "" {
+		if _, _, err = net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		g.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+	return g, nil
+}
+
+func (g *GeoIP) Close() error {
+	return g.db.Close()
+}
+
+// Lookup 返回服务器地址所在的国家, server可以是IP或域名
+func (g *GeoIP) Lookup(server string) (countries.CountryCode, error) {
+	g.mu.Lock()
+	entry, ok := g.cache[server]
+	g.mu.Unlock()
+	if ok && time.Now().Before(entry.expire) {
+		return entry.country, entry.err
+	}
+
+	country, err := g.lookup(server)
+	ttl := geoIPCacheTTL
+	if err != nil {
+		ttl = geoIPFailureTTL
+	}
+	g.mu.Lock()
+	g.cache[server] = geoIPEntry{country: country, err: err, expire: time.Now().Add(ttl)}
+	g.mu.Unlock()
+	return country, err
+}
+
+func (g *GeoIP) lookup(server string) (countries.CountryCode, error) {
+	ip := net.ParseIP(server)
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+		defer cancel()
+		addrs, err := g.resolver.LookupIPAddr(ctx, server)
+		if err != nil {
+			return countries.Unknown, err
+		}
+		if len(addrs) == 0 {
+			return countries.Unknown, fmt.Errorf("no address for %s", server)
+		}
+		ip = addrs[0].IP
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return countries.Unknown, err
+	}
+	if code := firstNonEmpty(record.Country.ISOCode, record.RegisteredCountry.ISOCode); code != "" {
+		return alpha2(code), nil
+	}
+	return countries.Unknown, nil
+}
+
+// serverLocator 按服务器地址识别国家, 便于测试时替换GeoIP
+type serverLocator interface {
+	Lookup(server string) (countries.CountryCode, error)
+}
+
+// geoIP 节点名无法识别国家时的后备, 为nil时不查询
+var geoIP serverLocator
+
+// UseGeoIP 启用按服务器地址识别国家, 传入nil关闭
+func UseGeoIP(g *GeoIP) {
+	if g == nil {
+		geoIP = nil
+		return
+	}
+	geoIP = g
+}
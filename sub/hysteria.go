@@ -0,0 +1,134 @@
+package sub
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	hysteriaPattern  = regexp.MustCompile("(?i)^hysteria://(.*)")
+	hysteria2Pattern = regexp.MustCompile("(?i)^(?:hysteria2|hy2)://(.*)")
+	portSpecPattern  = regexp.MustCompile(`^\d+(?:-\d+)?(?:,\d+(?:-\d+)?)*$`)
+)
+
+// hysteriaToClash 解析hysteria(v1)分享链接
+// hysteria://host:port?protocol=udp&auth=...&peer=...&insecure=1&upmbps=100&downmbps=100&alpn=h3&obfs=xplus&obfsParam=...#name
+// See: https://v1.hysteria.network/docs/uri-scheme/
+func hysteriaToClash(line []byte) (*Node, error) {
+	u, ports, err := parseHysteriaLink(line)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	node := Node{
+		Name:           u.Fragment,
+		Type:           "hysteria",
+		Server:         u.Hostname(),
+		Port:           u.Port(),
+		Ports:          firstNonEmpty(q.Get("mport"), ports),
+		AuthStr:        firstNonEmpty(q.Get("auth"), q.Get("auth_str")),
+		Protocol:       q.Get("protocol"),
+		Up:             firstNonEmpty(q.Get("upmbps"), q.Get("up")),
+		Down:           firstNonEmpty(q.Get("downmbps"), q.Get("down")),
+		SNI:            q.Get("peer"),
+		ALPN:           splitNonEmpty(q.Get("alpn"), ","),
+		SkipCertVerify: queryBool(q, "insecure"),
+		UDP:            true,
+	}
+	// 只有xplus一种混淆, Clash.Meta中obfs字段即为混淆密码
+	if q.Get("obfs") != "" {
+		node.Obfs = q.Get("obfsParam")
+	}
+	if node.Up == "" || node.Down == "" {
+		return nil, fmt.Errorf("invalid hysteria link: upmbps and downmbps are required")
+	}
+	return &node, nil
+}
+
+// hysteria2ToClash 解析hysteria2分享链接, hy2://为其简写
+// hysteria2://auth@host:port/?obfs=salamander&obfs-password=...&sni=...&insecure=1#name
+// See: https://v2.hysteria.network/docs/developers/URI-Scheme/
+func hysteria2ToClash(line []byte) (*Node, error) {
+	u, ports, err := parseHysteriaLink(line)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	node := Node{
+		Name:           u.Fragment,
+		Type:           "hysteria2",
+		Server:         u.Hostname(),
+		Port:           u.Port(),
+		Ports:          firstNonEmpty(q.Get("mport"), ports),
+		Up:             firstNonEmpty(q.Get("up"), q.Get("upmbps")),
+		Down:           firstNonEmpty(q.Get("down"), q.Get("downmbps")),
+		SNI:            q.Get("sni"),
+		ALPN:           splitNonEmpty(q.Get("alpn"), ","),
+		SkipCertVerify: queryBool(q, "insecure"),
+		UDP:            true,
+	}
+	if u.User != nil {
+		// user:pass形式的认证原样作为密码
+		node.Password = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			node.Password += ":" + password
+		}
+	}
+	if obfs := q.Get("obfs"); obfs != "" && obfs != "none" {
+		node.Obfs = obfs
+		node.ObfsPassword = q.Get("obfs-password")
+	}
+	return &node, nil
+}
+
+// parseHysteriaLink url.Parse不接受host:443,20000-30000这样的端口跳跃写法,
+// 先取出端口段, 以第一个端口作为port, 完整的端口段作为ports返回
+func parseHysteriaLink(line []byte) (u *url.URL, ports string, err error) {
+	link := string(line)
+	schemeEnd := strings.Index(link, "://")
+	if schemeEnd < 0 {
+		return nil, "", fmt.Errorf("invalid hysteria link")
+	}
+	rest := link[schemeEnd+3:]
+	authorityEnd := strings.IndexAny(rest, "/?#")
+	if authorityEnd < 0 {
+		authorityEnd = len(rest)
+	}
+	authority := rest[:authorityEnd]
+	portStart := strings.LastIndex(authority, ":")
+	if portStart < 0 || strings.Contains(authority[portStart:], "]") {
+		return nil, "", fmt.Errorf("invalid hysteria link: missing port")
+	}
+	portSpec := authority[portStart+1:]
+	if !portSpecPattern.MatchString(portSpec) {
+		return nil, "", fmt.Errorf("invalid hysteria link: bad port %q", portSpec)
+	}
+	if strings.ContainsAny(portSpec, ",-") {
+		ports = portSpec
+		portSpec = strings.FieldsFunc(portSpec, func(r rune) bool { return r == ',' || r == '-' })[0]
+	}
+	u, err = url.Parse(link[:schemeEnd+3] + authority[:portStart+1] + portSpec + rest[authorityEnd:])
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Hostname() == "" {
+		return nil, "", fmt.Errorf("invalid hysteria link: missing host")
+	}
+	if u.Fragment == "" {
+		u.Fragment = u.Host
+	}
+	return u, ports, nil
+}
+
+// DecodeHysteria 解析hysteria订阅, 每行为hysteria://链接
+func DecodeHysteria(res *http.Response) ([]Node, error) {
+	return decodeShareLinks(res, hysteriaPattern, hysteriaToClash)
+}
+
+// DecodeHysteria2 解析hysteria2订阅, 每行为hysteria2://或hy2://链接
+func DecodeHysteria2(res *http.Response) ([]Node, error) {
+	return decodeShareLinks(res, hysteria2Pattern, hysteria2ToClash)
+}
@@ -0,0 +1,211 @@
+package sub
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// RenderLoon 输出Loon配置
+// Loon不支持的节点(如tuic, wireguard)会被跳过, 并在[Proxy]中以注释列出
+// See: https://nsloon.app/docs/intro
+func RenderLoon(config ClashSub, out io.Writer) error {
+	w := bufio.NewWriter(out)
+	names := newNameSet()
+
+	w.WriteString("[General]\n")
+	w.WriteString("skip-proxy = 127.0.0.1, 192.168.0.0/16, 10.0.0.0/8, 172.16.0.0/12, localhost, *.local\n")
+	w.WriteString("allow-wifi-access = " + strconv.FormatBool(config.AllowLan) + "\n")
+
+	w.WriteString("\n[Proxy]\n")
+	var skipped []string
+	for _, node := range config.Proxies {
+		line, ok := loonProxy(node)
+		if !ok {
+			skipped = append(skipped, node.Name)
+			continue
+		}
+		names.add(node.Name)
+		w.WriteString(profileName(node.Name) + " = " + line + "\n")
+	}
+	writeSkipped(w, "#", skipped)
+
+	w.WriteString("\n[Proxy Group]\n")
+	for _, group := range supportedGroups(config.ProxyGroups, names, "select", "url-test", "fallback", "load-balance") {
+		items := []string{group.Type}
+		for _, proxy := range names.filter(group.Proxies) {
+			items = append(items, profileName(proxy))
+		}
+		if group.Type != "select" {
+			items = append(items, "url="+group.URL, "interval="+strconv.Itoa(group.Interval))
+		}
+		switch group.Type {
+		case "url-test":
+			if group.Tolerance > 0 {
+				items = append(items, "tolerance="+strconv.Itoa(group.Tolerance))
+			}
+		case "load-balance":
+			// Loon的pcc按目标地址固定节点, 相当于consistent-hashing
+			algorithm := "round-robin"
+			if group.Strategy == "consistent-hashing" {
+				algorithm = "pcc"
+			}
+			items = append(items, "algorithm="+algorithm)
+		}
+		w.WriteString(profileName(group.Name) + " = " + strings.Join(items, ",") + "\n")
+	}
+
+	var (
+		remoteRules []string
+		rules       []string
+	)
+	for _, r := range config.Rules {
+		ruleType, payload, target, options := r.Parts()
+		if !names.has(target) {
+			continue
+		}
+		target = profileName(target)
+		switch ruleType {
+		case "MATCH":
+			rules = append(rules, "FINAL,"+target)
+		case "RULE-SET":
+			provider, ok := config.RuleProviders[payload]
+			if !ok {
+				continue
+			}
+			remoteRules = append(remoteRules, strings.Join([]string{
+				provider.URL,
+				"policy=" + target,
+				"tag=" + payload,
+				"enabled=true",
+			}, ", "))
+		case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD", "IP-CIDR", "IP-CIDR6", "GEOIP", "DST-PORT":
+			rules = append(rules, strings.Join(append([]string{ruleType, payload, target}, options...), ","))
+		case "SRC-IP-CIDR":
+			rules = append(rules, strings.Join([]string{"SRC-IP", payload, target}, ","))
+		default:
+			log.Printf("loon: unsupported rule %s, skip", r)
+		}
+	}
+	w.WriteString("\n[Remote Rule]\n")
+	for _, line := range remoteRules {
+		w.WriteString(line + "\n")
+	}
+	w.WriteString("\n[Rule]\n")
+	for _, line := range rules {
+		w.WriteString(line + "\n")
+	}
+	return w.Flush()
+}
+
+func loonProxy(node Node) (string, bool) {
+	var items []string
+	tls := func() {
+		if sni := firstNonEmpty(node.SNI, node.ServerName); sni != "" {
+			items = append(items, "sni="+sni)
+		}
+		items = append(items, "skip-cert-verify="+strconv.FormatBool(node.SkipCertVerify))
+	}
+	transport := func() bool {
+		switch node.Network {
+		case "", "tcp":
+			items = append(items, "transport=tcp")
+		case "ws":
+			items = append(items, "transport=ws")
+			if node.WSOpts != nil {
+				items = append(items, "path="+firstNonEmpty(node.WSOpts.Path, "/"))
+				if host := node.WSOpts.Headers["Host"]; host != "" {
+					items = append(items, "host="+host)
+				}
+			}
+		case "h2":
+			items = append(items, "transport=http")
+			if node.H2Opts != nil {
+				items = append(items, "path="+firstNonEmpty(node.H2Opts.Path, "/"))
+				if len(node.H2Opts.Host) > 0 {
+					items = append(items, "host="+node.H2Opts.Host[0])
+				}
+			}
+		default:
+			return false
+		}
+		return true
+	}
+	quote := func(s string) string {
+		return `"` + s + `"`
+	}
+	switch node.Type {
+	case "ss":
+		items = append(items, "Shadowsocks", node.Server, node.Port, node.Cipher, quote(node.Password))
+		switch node.Plugin {
+		case "":
+		case "obfs":
+			if node.PluginOpts != nil {
+				items = append(items, "obfs-name="+node.PluginOpts.Mode)
+				if node.PluginOpts.Host != "" {
+					items = append(items, "obfs-host="+node.PluginOpts.Host)
+				}
+			}
+		default:
+			return "", false
+		}
+	case "ssr":
+		items = append(items, "ShadowsocksR", node.Server, node.Port, node.Cipher, quote(node.Password),
+			"protocol="+node.Protocol,
+			"protocol-param="+node.ProtocolParam,
+			"obfs="+node.Obfs,
+			"obfs-param="+node.ObfsParam,
+		)
+	case "vmess":
+		items = append(items, "vmess", node.Server, node.Port, firstNonEmpty(node.Cipher, "auto"), quote(node.UUID))
+		if !transport() {
+			return "", false
+		}
+		if node.AlterID != nil {
+			items = append(items, "alterId="+strconv.Itoa(*node.AlterID))
+		}
+		if node.TLS {
+			items = append(items, "over-tls=true")
+			tls()
+		}
+	case "vless":
+		if node.RealityOpts != nil || node.Flow != "" {
+			return "", false
+		}
+		items = append(items, "VLESS", node.Server, node.Port, quote(node.UUID))
+		if !transport() {
+			return "", false
+		}
+		if node.TLS {
+			items = append(items, "over-tls=true")
+			tls()
+		}
+	case "trojan":
+		items = append(items, "trojan", node.Server, node.Port, quote(node.Password))
+		if !transport() {
+			return "", false
+		}
+		tls()
+	case "hysteria2":
+		items = append(items, "Hysteria2", node.Server, node.Port, quote(node.Password))
+		tls()
+		if mbps := parseMbps(node.Down); mbps > 0 {
+			items = append(items, "download-bandwidth="+strconv.Itoa(mbps))
+		}
+	case "http":
+		items = append(items, "http", node.Server, node.Port)
+		if node.TLS {
+			items[0] = "https"
+			tls()
+		}
+	default:
+		return "", false
+	}
+	switch node.Type {
+	case "ss", "ssr", "vmess", "vless", "trojan":
+		items = append(items, "fast-open="+strconv.FormatBool(node.TFO), "udp="+strconv.FormatBool(node.UDP))
+	}
+	return strings.Join(items, ","), true
+}
@@ -0,0 +1,64 @@
+package sub
+
+import "strconv"
+
+// Source 一个上游订阅, Tag用于区分不同订阅中的重名节点
+type Source struct {
+	Tag    string
+	Remote ClashSub
+}
+
+// Merge 合并多个上游订阅, 合并后的结果交给Rewrite按国家分组即可跨机场
+// 节点名重复时为后出现的节点加上来源的Tag, tagPosition为"prefix"时加在名称前, 否则加在名称后.
+// proxy-groups, rules等只能保留第一个订阅的, 其中引用的节点名不会被修改
+func Merge(sources []Source, tagPosition string) ClashSub {
+	var merged ClashSub
+	if len(sources) == 0 {
+		return merged
+	}
+	first := sources[0].Remote
+	merged.ProxyGroups = first.ProxyGroups
+	merged.RuleProviders = first.RuleProviders
+	merged.Rules = first.Rules
+
+	seen := make(map[string]bool)
+	for _, source := range sources {
+		for _, node := range source.Remote.Proxies {
+			if seen[node.Name] {
+				node.Name = uniqueName(seen, tagName(node.Name, source.Tag, tagPosition))
+			}
+			seen[node.Name] = true
+			merged.Proxies = append(merged.Proxies, node)
+		}
+		for name, provider := range source.Remote.ProxyProviders {
+			if merged.ProxyProviders == nil {
+				merged.ProxyProviders = make(map[string]interface{})
+			}
+			if _, ok := merged.ProxyProviders[name]; ok {
+				name = tagName(name, source.Tag, tagPosition)
+			}
+			merged.ProxyProviders[name] = provider
+		}
+	}
+	return merged
+}
+
+func tagName(name, tag, tagPosition string) string {
+	if tagPosition == "prefix" {
+		return "[" + tag + "] " + name
+	}
+	return name + " [" + tag + "]"
+}
+
+// uniqueName 加上Tag后依然重名(同一订阅内重名)时追加序号
+func uniqueName(seen map[string]bool, name string) string {
+	if !seen[name] {
+		return name
+	}
+	for i := 2; ; i++ {
+		candidate := name + " " + strconv.Itoa(i)
+		if !seen[candidate] {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package sub
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/biter777/countries"
+)
+
+// NodeMeta 从节点名解析出的倍率, 线路类型和运营商, 供过滤和分组使用, 不会输出到配置中
+type NodeMeta struct {
+	Multiplier float64 `yaml:"multiplier"`          // 流量倍率, 没有标注时为1
+	LineType   string  `yaml:"line-type,omitempty"` // IPLC, IEPL, CN2, BGP, 家宽, 专线, 中转, 直连
+	ISP        string  `yaml:"isp,omitempty"`       // 电信, 联通, 移动, HiNet等
+
+	// 重命名之前识别到的国家, 见RenameNodes, 之后分组和过滤不再按新名称识别
+	Country   countries.CountryCode `yaml:"-"`
+	GeoSource GeoSource             `yaml:"-"`
+	located   bool
+}
+
+// ParseNodeMeta 解析节点名中的倍率, 线路类型和运营商
+func ParseNodeMeta(name string) NodeMeta {
+	return NodeMeta{
+		Multiplier: parseMultiplier(name),
+		LineType:   matchTag(lineTypes, name),
+		ISP:        matchTag(isps, name),
+	}
+}
+
+// Metadata 返回节点的NodeMeta, AnnotateNodes之后使用保存的结果, 否则从当前名称解析
+func (n Node) Metadata() NodeMeta {
+	if n.Meta != nil {
+		return *n.Meta
+	}
+	return ParseNodeMeta(n.Name)
+}
+
+// AnnotateNodes 返回保存了NodeMeta的副本, 之后重命名也不影响倍率等信息
+func AnnotateNodes(nodes []Node) []Node {
+	out := make([]Node, len(nodes))
+	for i, node := range nodes {
+		if node.Meta == nil {
+			meta := ParseNodeMeta(node.Name)
+			node.Meta = &meta
+		}
+		out[i] = node
+	}
+	return out
+}
+
+type tag struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+func matchTag(tags []tag, name string) string {
+	for _, t := range tags {
+		if t.pattern.MatchString(name) {
+			return t.name
+		}
+	}
+	return ""
+}
+
+// lineTypes 按顺序匹配, 如"IPLC 中转"为IPLC
+var lineTypes = []tag{
+	{"IPLC", regexp.MustCompile(`(?i)iplc`)},
+	{"IEPL", regexp.MustCompile(`(?i)iepl`)},
+	{"CN2", regexp.MustCompile(`(?i)cn2|\bgia\b`)},
+	{"BGP", regexp.MustCompile(`(?i)bgp`)},
+	{"家宽", regexp.MustCompile(`家宽|家庭宽带|住宅|(?i)residential`)},
+	{"专线", regexp.MustCompile(`专线`)},
+	{"中转", regexp.MustCompile(`中转|(?i)\brelay\b`)},
+	{"直连", regexp.MustCompile(`直连|(?i)\bdirect\b`)},
+}
+
+var isps = []tag{
+	{"电信", regexp.MustCompile(`电信|(?i)\bct\b|chinatelecom`)},
+	{"联通", regexp.MustCompile(`联通|(?i)\bcu\b|unicom`)},
+	{"移动", regexp.MustCompile(`移动|(?i)\bcm\b|cmcc|chinamobile`)},
+	{"广电", regexp.MustCompile(`广电`)},
+	{"HiNet", regexp.MustCompile(`(?i)hinet`)},
+	{"NTT", regexp.MustCompile(`(?i)\bntt\b`)},
+	{"SoftBank", regexp.MustCompile(`(?i)softbank`)},
+	{"KDDI", regexp.MustCompile(`(?i)kddi`)},
+	{"AWS", regexp.MustCompile(`(?i)\baws\b`)},
+	{"Oracle", regexp.MustCompile(`(?i)oracle`)},
+	{"Azure", regexp.MustCompile(`(?i)azure`)},
+	{"GCP", regexp.MustCompile(`(?i)\bgcp\b|google cloud`)},
+}
+
+// multiplierPatterns 节点名中的流量倍率, 如"倍率:0.5", "2倍率", "x1.5", "0.5x"
+// "倍率 2"先于"2倍"匹配, 以免"香港 01 倍率 2"中的编号被当作倍率
+var multiplierPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?:^|[^\d.])倍率\s*[:：]?\s*(\d+(?:\.\d+)?)`),
+	regexp.MustCompile(`(\d+(?:\.\d+)?)倍`),
+	regexp.MustCompile(`(?:^|[^A-Za-z0-9.])[xX×]\s*(\d+(?:\.\d+)?)(?:[^0-9A-Za-z.]|$)`),
+	regexp.MustCompile(`(?:^|[^A-Za-z0-9.])(\d+(?:\.\d+)?)\s*[xX×](?:[^A-Za-z0-9]|$)`),
+}
+
+// parseMultiplier 解析节点名中的流量倍率, 没有标注时为1
+func parseMultiplier(name string) float64 {
+	for _, pattern := range multiplierPatterns {
+		if match := pattern.FindStringSubmatch(name); match != nil {
+			if m, err := strconv.ParseFloat(match[1], 64); err == nil {
+				return m
+			}
+		}
+	}
+	return 1
+}
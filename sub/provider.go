@@ -0,0 +1,91 @@
+package sub
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/biter777/countries"
+	"gopkg.in/yaml.v3"
+)
+
+// ProxyProvider proxy-providers引用的文件, 只包含节点
+type ProxyProvider struct {
+	Proxies []Node `yaml:"proxies"`
+}
+
+// RuleProviderPayload rule-providers引用的文件, behavior为classical
+type RuleProviderPayload struct {
+	Payload []string `yaml:"payload"`
+}
+
+// FilterProxies 按国家和名称过滤节点, codes为空时不按国家过滤, pattern为nil时不按名称过滤
+// 国家按geo识别, 即布局中的geo-overrides也生效
+func FilterProxies(nodes []Node, geo *GeoMatcher, codes []countries.CountryCode, pattern *regexp.Regexp) []Node {
+	var out []Node
+	for _, node := range nodes {
+		if len(codes) > 0 {
+			country := geo.locateOrLog(node)
+			matched := false
+			for _, code := range codes {
+				matched = matched || country == code
+			}
+			if !matched {
+				continue
+			}
+		}
+		if pattern != nil && !pattern.MatchString(node.Name) {
+			continue
+		}
+		out = append(out, node)
+	}
+	return out
+}
+
+// RenderProxyProvider 输出proxy-provider文件
+func RenderProxyProvider(nodes []Node, out io.Writer) error {
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	return encoder.Encode(&ProxyProvider{Proxies: nodes})
+}
+
+// RenderRuleProvider 输出布局中名为name的规则列表, 去掉规则中的策略组
+func (t *Template) RenderRuleProvider(name string, out io.Writer) error {
+	rules, ok := t.RuleList(name)
+	if !ok {
+		return fmt.Errorf("unknown rule list %q", name)
+	}
+	var payload RuleProviderPayload
+	for _, r := range rules {
+		ruleType, value, _, options := r.Parts()
+		payload.Payload = append(payload.Payload, strings.Join(append([]string{ruleType, value}, options...), ","))
+	}
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	return encoder.Encode(&payload)
+}
+
+// GeoReportItem 节点的国家识别结果
+type GeoReportItem struct {
+	Name    string    `yaml:"name"`
+	Server  string    `yaml:"server"`
+	Country string    `yaml:"country"`
+	Source  GeoSource `yaml:"source"`
+}
+
+// RenderGeoReport 输出每个节点识别到的国家及来源(节点名或GeoIP), 用于排查分组
+func RenderGeoReport(nodes []Node, geo *GeoMatcher, out io.Writer) error {
+	var items []GeoReportItem
+	for _, node := range nodes {
+		c, source := geo.Locate(node)
+		item := GeoReportItem{Name: node.Name, Server: node.Server, Source: source}
+		if c != countries.Unknown {
+			item.Country = c.Alpha2()
+		}
+		items = append(items, item)
+	}
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	return encoder.Encode(items)
+}
@@ -0,0 +1,243 @@
+package sub
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// RenderQuantumultX 输出Quantumult X配置
+// Quantumult X不支持的节点(如hysteria, tuic)会被跳过, 并在[server_local]中以注释列出
+// See: https://github.com/crossutility/Quantumult-X/blob/master/sample.conf
+func RenderQuantumultX(config ClashSub, out io.Writer) error {
+	w := bufio.NewWriter(out)
+	names := newNameSet()
+
+	var (
+		servers []string
+		skipped []string
+	)
+	for _, node := range config.Proxies {
+		line, ok := quanXServer(node)
+		if !ok {
+			skipped = append(skipped, node.Name)
+			continue
+		}
+		names.add(node.Name)
+		servers = append(servers, line+", tag="+profileName(node.Name))
+	}
+
+	w.WriteString("[general]\n")
+	w.WriteString("server_check_url=http://www.gstatic.com/generate_204\n")
+
+	w.WriteString("\n[policy]\n")
+	for _, group := range supportedGroups(config.ProxyGroups, names, "select", "url-test", "fallback", "load-balance") {
+		policyType := map[string]string{
+			"select":       "static",
+			"url-test":     "url-latency-benchmark",
+			"fallback":     "available",
+			"load-balance": "round-robin",
+		}[group.Type]
+		items := []string{profileName(group.Name)}
+		for _, proxy := range names.filter(group.Proxies) {
+			items = append(items, quanXPolicy(proxy))
+		}
+		if group.Type == "url-test" {
+			items = append(items, "check-interval="+strconv.Itoa(group.Interval))
+			if group.Tolerance > 0 {
+				items = append(items, "tolerance="+strconv.Itoa(group.Tolerance))
+			}
+		}
+		w.WriteString(policyType + "=" + strings.Join(items, ", ") + "\n")
+	}
+
+	w.WriteString("\n[server_local]\n")
+	for _, line := range servers {
+		w.WriteString(line + "\n")
+	}
+	writeSkipped(w, "#", skipped)
+
+	var (
+		filterRemote []string
+		filterLocal  []string
+	)
+	for _, r := range config.Rules {
+		ruleType, payload, target, options := r.Parts()
+		if !names.has(target) {
+			continue
+		}
+		target = quanXPolicy(target)
+		switch ruleType {
+		case "MATCH":
+			filterLocal = append(filterLocal, "final, "+target)
+		case "RULE-SET":
+			provider, ok := config.RuleProviders[payload]
+			if !ok {
+				continue
+			}
+			filterRemote = append(filterRemote, strings.Join([]string{
+				provider.URL,
+				"tag=" + payload,
+				"force-policy=" + target,
+				"update-interval=86400",
+				"opt-parser=true",
+				"enabled=true",
+			}, ", "))
+		case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD", "IP-CIDR", "IP-CIDR6", "GEOIP":
+			qxType := map[string]string{
+				"DOMAIN":         "host",
+				"DOMAIN-SUFFIX":  "host-suffix",
+				"DOMAIN-KEYWORD": "host-keyword",
+				"IP-CIDR":        "ip-cidr",
+				"IP-CIDR6":       "ip6-cidr",
+				"GEOIP":          "geoip",
+			}[ruleType]
+			filterLocal = append(filterLocal, strings.Join(append([]string{qxType, payload, target}, options...), ", "))
+		default:
+			log.Printf("quantumult x: unsupported rule %s, skip", r)
+		}
+	}
+	// final必须是最后一条
+	w.WriteString("\n[filter_remote]\n")
+	for _, line := range filterRemote {
+		w.WriteString(line + "\n")
+	}
+	w.WriteString("\n[filter_local]\n")
+	for _, line := range filterLocal {
+		w.WriteString(line + "\n")
+	}
+	return w.Flush()
+}
+
+// quanXPolicy Quantumult X的内置策略为小写
+func quanXPolicy(name string) string {
+	switch name {
+	case DIRECT:
+		return "direct"
+	case REJECT:
+		return "reject"
+	}
+	return profileName(name)
+}
+
+func quanXServer(node Node) (string, bool) {
+	var items []string
+	tls := func() {
+		if sni := firstNonEmpty(node.SNI, node.ServerName); sni != "" {
+			items = append(items, "tls-host="+sni)
+		}
+		items = append(items, "tls-verification="+strconv.FormatBool(!node.SkipCertVerify))
+	}
+	address := node.Server + ":" + node.Port
+	switch node.Type {
+	case "ss":
+		items = append(items, "shadowsocks="+address, "method="+node.Cipher, "password="+node.Password)
+		switch node.Plugin {
+		case "":
+		case "obfs":
+			if node.PluginOpts != nil {
+				items = append(items, "obfs="+node.PluginOpts.Mode)
+				if node.PluginOpts.Host != "" {
+					items = append(items, "obfs-host="+node.PluginOpts.Host)
+				}
+			}
+		case "v2ray-plugin":
+			if node.PluginOpts != nil {
+				obfs := "ws"
+				if node.PluginOpts.TLS {
+					obfs = "wss"
+				}
+				items = append(items, "obfs="+obfs)
+				if node.PluginOpts.Host != "" {
+					items = append(items, "obfs-host="+node.PluginOpts.Host)
+				}
+				items = append(items, "obfs-uri="+firstNonEmpty(node.PluginOpts.Path, "/"))
+			}
+		default:
+			return "", false
+		}
+	case "ssr":
+		items = append(items,
+			"shadowsocks="+address,
+			"method="+node.Cipher,
+			"password="+node.Password,
+			"ssr-protocol="+node.Protocol,
+			"ssr-protocol-param="+node.ProtocolParam,
+			"obfs="+node.Obfs,
+			"obfs-host="+node.ObfsParam,
+		)
+	case "vmess", "vless":
+		method := "none"
+		if node.Type == "vmess" {
+			// Quantumult X的vmess只支持这几种加密
+			method = "chacha20-poly1305"
+			if node.Cipher == "aes-128-gcm" || node.Cipher == "none" {
+				method = node.Cipher
+			}
+		} else if node.RealityOpts != nil || node.Flow != "" {
+			return "", false
+		}
+		items = append(items, node.Type+"="+address, "method="+method, "password="+node.UUID)
+		switch node.Network {
+		case "", "tcp":
+			if node.TLS {
+				items = append(items, "obfs=over-tls")
+				tls()
+			}
+		case "ws":
+			obfs := "ws"
+			if node.TLS {
+				obfs = "wss"
+			}
+			items = append(items, "obfs="+obfs)
+			if node.WSOpts != nil {
+				if host := node.WSOpts.Headers["Host"]; host != "" {
+					items = append(items, "obfs-host="+host)
+				}
+				items = append(items, "obfs-uri="+firstNonEmpty(node.WSOpts.Path, "/"))
+			}
+			if node.TLS {
+				tls()
+			}
+		default:
+			return "", false
+		}
+		if node.Type == "vmess" && (node.AlterID == nil || *node.AlterID == 0) {
+			items = append(items, "aead=true")
+		}
+	case "trojan":
+		items = append(items, "trojan="+address, "password="+node.Password)
+		switch node.Network {
+		case "", "tcp":
+			items = append(items, "over-tls=true")
+		case "ws":
+			items = append(items, "obfs=wss")
+			if node.WSOpts != nil {
+				if host := node.WSOpts.Headers["Host"]; host != "" {
+					items = append(items, "obfs-host="+host)
+				}
+				items = append(items, "obfs-uri="+firstNonEmpty(node.WSOpts.Path, "/"))
+			}
+		default:
+			return "", false
+		}
+		tls()
+	case "http":
+		items = append(items, "http="+address)
+		if node.TLS {
+			items = append(items, "over-tls=true")
+			tls()
+		}
+	default:
+		return "", false
+	}
+	if node.TFO {
+		items = append(items, "fast-open=true")
+	}
+	if node.UDP && node.Type != "http" {
+		items = append(items, "udp-relay=true")
+	}
+	return strings.Join(items, ", "), true
+}
@@ -0,0 +1,149 @@
+package sub
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/biter777/countries"
+)
+
+// RenameStep 重命名的一步, 每步只写一种操作:
+//
+//	replace: 正则, with: 替换内容, 可用$1引用分组
+//	strip: 去掉的词, 如["倍率", "IPLC"]
+//	flag: true 按识别到的国家加上国旗emoji, 已有国旗的不加
+//	renumber: 位数, 按国家重新编号, 如"香港 01", "香港 02"
+type RenameStep struct {
+	Replace  string   `yaml:"replace,omitempty"`
+	With     string   `yaml:"with,omitempty"`
+	Strip    []string `yaml:"strip,omitempty"`
+	Flag     bool     `yaml:"flag,omitempty"`
+	Renumber int      `yaml:"renumber,omitempty"`
+}
+
+var spaces = regexp.MustCompile(`\s+`)
+
+func compileRenameSteps(steps []RenameStep) ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, len(steps))
+	for i, step := range steps {
+		if step.Replace == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(step.Replace)
+		if err != nil {
+			return nil, fmt.Errorf("rename %q: %w", step.Replace, err)
+		}
+		patterns[i] = pattern
+	}
+	return patterns, nil
+}
+
+// RenameNodes 按顺序执行重命名, 返回的副本中proxy-groups和规则对节点的引用会一并改名
+// 国旗, 编号以及之后的分组和过滤都使用改名前识别到的国家, 改名后重名的节点追加序号
+func RenameNodes(remote ClashSub, steps []RenameStep, geo *GeoMatcher) (ClashSub, error) {
+	if len(steps) == 0 {
+		return remote, nil
+	}
+	patterns, err := compileRenameSteps(steps)
+	if err != nil {
+		return remote, err
+	}
+	located := make([]countries.CountryCode, len(remote.Proxies))
+	sources := make([]GeoSource, len(remote.Proxies))
+	names := make([]string, len(remote.Proxies))
+	for i, node := range remote.Proxies {
+		located[i], sources[i] = geo.Locate(node)
+		names[i] = node.Name
+	}
+
+	for i, step := range steps {
+		counter := make(map[countries.CountryCode]int)
+		for j := range names {
+			name := names[j]
+			switch {
+			case patterns[i] != nil:
+				name = patterns[i].ReplaceAllString(name, step.With)
+			case len(step.Strip) > 0:
+				for _, token := range step.Strip {
+					name = strings.ReplaceAll(name, token, " ")
+				}
+			case step.Flag:
+				if located[j] != countries.Unknown && matchFlag(name) == countries.Unknown {
+					name = located[j].Emoji() + name
+				}
+			case step.Renumber > 0:
+				counter[located[j]]++
+				name = fmt.Sprintf("%s %0*d", name, step.Renumber, counter[located[j]])
+			}
+			names[j] = strings.TrimSpace(spaces.ReplaceAllString(name, " "))
+		}
+	}
+
+	renamed := make(map[string]string)
+	seen := make(map[string]bool)
+	proxies := make([]Node, len(remote.Proxies))
+	for i, node := range remote.Proxies {
+		// 保存改名前的国家和倍率等信息, 改名后不会被分到别的国家
+		meta := node.Metadata()
+		meta.Country, meta.GeoSource, meta.located = located[i], sources[i], true
+		node.Meta = &meta
+		name := uniqueName(seen, names[i])
+		seen[name] = true
+		renamed[node.Name] = name
+		node.Name = name
+		proxies[i] = node
+	}
+	remote.Proxies = proxies
+
+	renameReferences(&remote, renamed)
+	return remote, nil
+}
+
+// renameReferences 替换proxy-groups, 规则和dialer-proxy中对节点的引用, 替换后分组中重复的成员只保留一个
+func renameReferences(remote *ClashSub, renamed map[string]string) {
+	for i, node := range remote.Proxies {
+		if name, ok := renamed[node.DialerProxy]; ok {
+			remote.Proxies[i].DialerProxy = name
+		}
+	}
+	groups := make([]ProxyGroup, len(remote.ProxyGroups))
+	for i, g := range remote.ProxyGroups {
+		var (
+			members []string
+			seen    = make(map[string]bool)
+		)
+		for _, m := range g.Proxies {
+			m = firstNonEmpty(renamed[m], m)
+			if !seen[m] {
+				seen[m] = true
+				members = append(members, m)
+			}
+		}
+		g.Proxies = members
+		groups[i] = g
+	}
+	remote.ProxyGroups = groups
+
+	rules := make([]Rule, len(remote.Rules))
+	for i, r := range remote.Rules {
+		rules[i] = renameRuleTarget(r, renamed)
+	}
+	remote.Rules = rules
+}
+
+// renameRuleTarget 规则的目标是被改名的节点时替换为新名称
+func renameRuleTarget(r Rule, renamed map[string]string) Rule {
+	ruleType, _, target, _ := r.Parts()
+	name, ok := renamed[target]
+	if !ok {
+		return r
+	}
+	items := strings.Split(r.String(), ",")
+	if ruleType == "MATCH" {
+		items[1] = name
+	} else {
+		items[2] = name
+	}
+	return Rule(strings.Join(items, ","))
+}
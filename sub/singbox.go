@@ -0,0 +1,516 @@
+package sub
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// sing-box配置, 只包含转换需要的字段
+// See: https://sing-box.sagernet.org/configuration/
+type singBoxConfig struct {
+	Log          *singBoxLog          `json:"log,omitempty"`
+	Inbounds     []singBoxInbound     `json:"inbounds"`
+	Outbounds    []singBoxOutbound    `json:"outbounds"`
+	Route        singBoxRoute         `json:"route"`
+	Experimental *singBoxExperimental `json:"experimental,omitempty"`
+}
+
+type singBoxLog struct {
+	Level string `json:"level,omitempty"`
+}
+
+type singBoxInbound struct {
+	Type       string `json:"type"`
+	Tag        string `json:"tag"`
+	Listen     string `json:"listen"`
+	ListenPort int    `json:"listen_port"`
+}
+
+type singBoxOutbound struct {
+	Type       string `json:"type"`
+	Tag        string `json:"tag"`
+	Server     string `json:"server,omitempty"`
+	ServerPort int    `json:"server_port,omitempty"`
+
+	// shadowsocks
+	Method     string `json:"method,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Plugin     string `json:"plugin,omitempty"`
+	PluginOpts string `json:"plugin_opts,omitempty"`
+
+	// vmess, vless, tuic
+	UUID     string `json:"uuid,omitempty"`
+	Security string `json:"security,omitempty"`
+	AlterID  int    `json:"alter_id,omitempty"`
+	Flow     string `json:"flow,omitempty"`
+
+	// hysteria, hysteria2, obfs在hysteria中是字符串, hysteria2中是对象
+	UpMbps   int         `json:"up_mbps,omitempty"`
+	DownMbps int         `json:"down_mbps,omitempty"`
+	AuthStr  string      `json:"auth_str,omitempty"`
+	Obfs     interface{} `json:"obfs,omitempty"`
+
+	// tuic
+	CongestionControl string `json:"congestion_control,omitempty"`
+	UDPRelayMode      string `json:"udp_relay_mode,omitempty"`
+
+	// wireguard
+	LocalAddress  []string `json:"local_address,omitempty"`
+	PrivateKey    string   `json:"private_key,omitempty"`
+	PeerPublicKey string   `json:"peer_public_key,omitempty"`
+	PreSharedKey  string   `json:"pre_shared_key,omitempty"`
+	Reserved      []int    `json:"reserved,omitempty"`
+	MTU           int      `json:"mtu,omitempty"`
+
+	TLS       *singBoxTLS       `json:"tls,omitempty"`
+	Transport *singBoxTransport `json:"transport,omitempty"`
+
+	// selector, urltest
+	Outbounds []string `json:"outbounds,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	Interval  string   `json:"interval,omitempty"`
+	Tolerance int      `json:"tolerance,omitempty"`
+}
+
+type singBoxTLS struct {
+	Enabled    bool            `json:"enabled"`
+	ServerName string          `json:"server_name,omitempty"`
+	Insecure   bool            `json:"insecure,omitempty"`
+	ALPN       []string        `json:"alpn,omitempty"`
+	UTLS       *singBoxUTLS    `json:"utls,omitempty"`
+	Reality    *singBoxReality `json:"reality,omitempty"`
+}
+
+type singBoxUTLS struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type singBoxReality struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key"`
+	ShortID   string `json:"short_id,omitempty"`
+}
+
+type singBoxTransport struct {
+	Type        string            `json:"type"`
+	Host        []string          `json:"host,omitempty"`
+	Path        string            `json:"path,omitempty"`
+	Method      string            `json:"method,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+}
+
+type singBoxRoute struct {
+	Rules   []singBoxRule    `json:"rules"`
+	RuleSet []singBoxRuleSet `json:"rule_set,omitempty"`
+	Final   string           `json:"final,omitempty"`
+}
+
+type singBoxRule struct {
+	Domain        []string `json:"domain,omitempty"`
+	DomainSuffix  []string `json:"domain_suffix,omitempty"`
+	DomainKeyword []string `json:"domain_keyword,omitempty"`
+	IPCIDR        []string `json:"ip_cidr,omitempty"`
+	SourceIPCIDR  []string `json:"source_ip_cidr,omitempty"`
+	Port          []int    `json:"port,omitempty"`
+	ProcessName   []string `json:"process_name,omitempty"`
+	RuleSet       []string `json:"rule_set,omitempty"`
+	Outbound      string   `json:"outbound"`
+}
+
+type singBoxRuleSet struct {
+	Type   string `json:"type"`
+	Tag    string `json:"tag"`
+	Format string `json:"format"`
+	URL    string `json:"url"`
+}
+
+type singBoxExperimental struct {
+	ClashAPI *singBoxClashAPI `json:"clash_api,omitempty"`
+}
+
+type singBoxClashAPI struct {
+	ExternalController string `json:"external_controller,omitempty"`
+	Secret             string `json:"secret,omitempty"`
+}
+
+const (
+	metaGeoSite = "https://raw.githubusercontent.com/MetaCubeX/meta-rules-dat/sing/geo/geosite/"
+	metaGeoIP   = "https://raw.githubusercontent.com/MetaCubeX/meta-rules-dat/sing/geo/geoip/"
+)
+
+// sing-box不能读取Clash格式的规则集, 内置的rule-providers对应到MetaCubeX的sing-box规则集
+var singBoxRuleSets = map[string]string{
+	"reject":       metaGeoSite + "category-ads-all.srs",
+	"icloud":       metaGeoSite + "icloud.srs",
+	"apple":        metaGeoSite + "apple.srs",
+	"google":       metaGeoSite + "google.srs",
+	"proxy":        metaGeoSite + "geolocation-!cn.srs",
+	"direct":       metaGeoSite + "cn.srs",
+	"private":      metaGeoSite + "private.srs",
+	"gfw":          metaGeoSite + "gfw.srs",
+	"greatfire":    metaGeoSite + "greatfire.srs",
+	"tld-not-cn":   metaGeoSite + "tld-!cn.srs",
+	"telegramcidr": metaGeoIP + "telegram.srs",
+	"cncidr":       metaGeoIP + "cn.srs",
+	"lancidr":      metaGeoIP + "private.srs",
+	"microsoft":    metaGeoSite + "microsoft.srs",
+	"github":       metaGeoSite + "github.srs",
+	"steam":        metaGeoSite + "steam.srs",
+	"youtube":      metaGeoSite + "youtube.srs",
+	"amazon":       metaGeoSite + "amazon.srs",
+}
+
+// RenderSingBox 输出sing-box配置
+// sing-box不支持的节点(如ssr)和分组(如relay)会被跳过, 分组中对它们的引用一并去掉
+func RenderSingBox(config ClashSub, out io.Writer) error {
+	sb := singBoxConfig{
+		Log: &singBoxLog{Level: config.LogLevel},
+	}
+	if config.MixedPort != 0 {
+		listen := "127.0.0.1"
+		if config.AllowLan {
+			listen = "0.0.0.0"
+		}
+		sb.Inbounds = append(sb.Inbounds, singBoxInbound{
+			Type:       "mixed",
+			Tag:        "mixed-in",
+			Listen:     listen,
+			ListenPort: config.MixedPort,
+		})
+	}
+	if config.ExternalController != "" {
+		sb.Experimental = &singBoxExperimental{ClashAPI: &singBoxClashAPI{
+			ExternalController: config.ExternalController,
+			Secret:             config.Secret,
+		}}
+	}
+
+	available := map[string]bool{DIRECT: true, REJECT: true}
+	var nodes []singBoxOutbound
+	for _, node := range config.Proxies {
+		outbound, ok := singBoxNode(node)
+		if !ok {
+			log.Printf("sing-box: unsupported node %s (%s), skip", node.Name, node.Type)
+			continue
+		}
+		available[node.Name] = true
+		nodes = append(nodes, outbound)
+	}
+	var groups []ProxyGroup
+	for _, group := range config.ProxyGroups {
+		switch group.Type {
+		case "select", "url-test", "fallback", "load-balance":
+			available[group.Name] = true
+			groups = append(groups, group)
+		default:
+			log.Printf("sing-box: unsupported group %s (%s), skip", group.Name, group.Type)
+		}
+	}
+	// 分组放在最前面, sing-box以第一个出站作为默认出站
+	for _, group := range groups {
+		sb.Outbounds = append(sb.Outbounds, singBoxGroup(group, available))
+	}
+	sb.Outbounds = append(sb.Outbounds, nodes...)
+	sb.Outbounds = append(sb.Outbounds,
+		singBoxOutbound{Type: "direct", Tag: DIRECT},
+		singBoxOutbound{Type: "block", Tag: REJECT},
+	)
+
+	ruleSets := make(map[string]bool)
+	addRuleSet := func(tag, url string) {
+		if ruleSets[tag] {
+			return
+		}
+		ruleSets[tag] = true
+		format := "binary"
+		if strings.HasSuffix(url, ".json") {
+			format = "source"
+		}
+		sb.Route.RuleSet = append(sb.Route.RuleSet, singBoxRuleSet{
+			Type: "remote", Tag: tag, Format: format, URL: url,
+		})
+	}
+	for _, r := range config.Rules {
+		ruleType, payload, target, _ := r.Parts()
+		if !available[target] {
+			log.Printf("sing-box: rule %s targets unknown outbound, skip", r)
+			continue
+		}
+		rule := singBoxRule{Outbound: target}
+		switch ruleType {
+		case "MATCH":
+			sb.Route.Final = target
+			continue
+		case "DOMAIN":
+			rule.Domain = []string{payload}
+		case "DOMAIN-SUFFIX":
+			rule.DomainSuffix = []string{payload}
+		case "DOMAIN-KEYWORD":
+			rule.DomainKeyword = []string{payload}
+		case "IP-CIDR", "IP-CIDR6":
+			rule.IPCIDR = []string{payload}
+		case "SRC-IP-CIDR":
+			rule.SourceIPCIDR = []string{payload}
+		case "DST-PORT":
+			port, err := strconv.Atoi(payload)
+			if err != nil {
+				continue
+			}
+			rule.Port = []int{port}
+		case "PROCESS-NAME":
+			rule.ProcessName = []string{payload}
+		case "GEOIP":
+			tag := "geoip-" + strings.ToLower(payload)
+			addRuleSet(tag, metaGeoIP+strings.ToLower(payload)+".srs")
+			rule.RuleSet = []string{tag}
+		case "GEOSITE":
+			tag := "geosite-" + strings.ToLower(payload)
+			addRuleSet(tag, metaGeoSite+strings.ToLower(payload)+".srs")
+			rule.RuleSet = []string{tag}
+		case "RULE-SET":
+			provider, ok := config.RuleProviders[payload]
+			if !ok {
+				continue
+			}
+			url, ok := singBoxRuleSets[payload]
+			if !ok && (strings.HasSuffix(provider.URL, ".srs") || strings.HasSuffix(provider.URL, ".json")) {
+				url, ok = provider.URL, true
+			}
+			if !ok {
+				log.Printf("sing-box: rule-provider %s has no sing-box rule set, skip", payload)
+				continue
+			}
+			addRuleSet(payload, url)
+			rule.RuleSet = []string{payload}
+		default:
+			log.Printf("sing-box: unsupported rule %s, skip", r)
+			continue
+		}
+		sb.Route.Rules = append(sb.Route.Rules, rule)
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(&sb)
+}
+
+func singBoxGroup(group ProxyGroup, available map[string]bool) singBoxOutbound {
+	outbound := singBoxOutbound{Type: "selector", Tag: group.Name}
+	if group.Type != "select" {
+		// fallback和load-balance在sing-box中没有对应, 以urltest代替
+		outbound.Type = "urltest"
+		outbound.URL = group.URL
+		if group.Interval > 0 {
+			outbound.Interval = strconv.Itoa(group.Interval) + "s"
+		}
+		outbound.Tolerance = group.Tolerance
+	}
+	for _, proxy := range group.Proxies {
+		if available[proxy] {
+			outbound.Outbounds = append(outbound.Outbounds, proxy)
+		}
+	}
+	if len(outbound.Outbounds) == 0 {
+		outbound.Outbounds = []string{DIRECT}
+	}
+	return outbound
+}
+
+func singBoxNode(node Node) (singBoxOutbound, bool) {
+	port, err := strconv.Atoi(node.Port)
+	if err != nil {
+		return singBoxOutbound{}, false
+	}
+	outbound := singBoxOutbound{
+		Tag:        node.Name,
+		Server:     node.Server,
+		ServerPort: port,
+	}
+	tls := &singBoxTLS{
+		Enabled:    true,
+		ServerName: firstNonEmpty(node.SNI, node.ServerName),
+		Insecure:   node.SkipCertVerify,
+		ALPN:       node.ALPN,
+	}
+	if node.ClientFingerprint != "" {
+		tls.UTLS = &singBoxUTLS{Enabled: true, Fingerprint: node.ClientFingerprint}
+	}
+	switch node.Type {
+	case "ss":
+		outbound.Type = "shadowsocks"
+		outbound.Method = node.Cipher
+		outbound.Password = node.Password
+		switch node.Plugin {
+		case "":
+		case "obfs", "v2ray-plugin":
+			outbound.Plugin, outbound.PluginOpts, _ = sip002Plugin(node)
+		default:
+			return outbound, false
+		}
+	case "vmess":
+		outbound.Type = "vmess"
+		outbound.UUID = node.UUID
+		outbound.Security = node.Cipher
+		if node.AlterID != nil {
+			outbound.AlterID = *node.AlterID
+		}
+		if node.TLS {
+			outbound.TLS = tls
+		}
+	case "vless":
+		outbound.Type = "vless"
+		outbound.UUID = node.UUID
+		outbound.Flow = node.Flow
+		if node.TLS {
+			outbound.TLS = tls
+		}
+		if node.RealityOpts != nil {
+			tls.Reality = &singBoxReality{
+				Enabled:   true,
+				PublicKey: node.RealityOpts.PublicKey,
+				ShortID:   node.RealityOpts.ShortID,
+			}
+		}
+	case "trojan":
+		outbound.Type = "trojan"
+		outbound.Password = node.Password
+		outbound.TLS = tls
+	case "hysteria":
+		outbound.Type = "hysteria"
+		outbound.AuthStr = node.AuthStr
+		outbound.UpMbps, outbound.DownMbps = parseMbps(node.Up), parseMbps(node.Down)
+		if node.Obfs != "" {
+			outbound.Obfs = node.Obfs
+		}
+		outbound.TLS = tls
+	case "hysteria2":
+		outbound.Type = "hysteria2"
+		outbound.Password = node.Password
+		outbound.UpMbps, outbound.DownMbps = parseMbps(node.Up), parseMbps(node.Down)
+		if node.Obfs != "" {
+			outbound.Obfs = map[string]string{"type": node.Obfs, "password": node.ObfsPassword}
+		}
+		outbound.TLS = tls
+	case "tuic":
+		outbound.Type = "tuic"
+		outbound.UUID = node.UUID
+		outbound.Password = node.Password
+		outbound.CongestionControl = node.CongestionController
+		outbound.UDPRelayMode = node.UDPRelayMode
+		outbound.TLS = tls
+	case "wireguard":
+		outbound.Type = "wireguard"
+		outbound.PrivateKey = node.PrivateKey
+		outbound.PeerPublicKey = node.PublicKey
+		outbound.PreSharedKey = node.PreSharedKey
+		outbound.Reserved = node.Reserved
+		outbound.MTU = node.MTU
+		if node.IP != "" {
+			outbound.LocalAddress = append(outbound.LocalAddress, node.IP+"/32")
+		}
+		if node.IPv6 != "" {
+			outbound.LocalAddress = append(outbound.LocalAddress, node.IPv6+"/128")
+		}
+	case "http":
+		outbound.Type = "http"
+		if node.TLS {
+			outbound.TLS = tls
+		}
+	case "socks5":
+		outbound.Type = "socks"
+	default:
+		return outbound, false
+	}
+	switch node.Network {
+	case "ws":
+		outbound.Transport = &singBoxTransport{Type: "ws"}
+		if node.WSOpts != nil {
+			outbound.Transport.Path = node.WSOpts.Path
+			outbound.Transport.Headers = node.WSOpts.Headers
+		}
+	case "h2":
+		outbound.Transport = &singBoxTransport{Type: "http"}
+		if node.H2Opts != nil {
+			outbound.Transport.Host = node.H2Opts.Host
+			outbound.Transport.Path = node.H2Opts.Path
+		}
+	case "http":
+		outbound.Transport = &singBoxTransport{Type: "http"}
+		if node.HTTPOpts != nil {
+			outbound.Transport.Method = node.HTTPOpts.Method
+			outbound.Transport.Host = node.HTTPOpts.Headers["Host"]
+			if len(node.HTTPOpts.Path) > 0 {
+				outbound.Transport.Path = node.HTTPOpts.Path[0]
+			}
+		}
+	case "grpc":
+		outbound.Transport = &singBoxTransport{Type: "grpc"}
+		if node.GrpcOpts != nil {
+			outbound.Transport.ServiceName = node.GrpcOpts.GrpcServiceName
+		}
+	}
+	return outbound, true
+}
+
+// sip002Plugin 将Clash的plugin-opts还原为SIP002的插件参数, 是SSPlugin的逆过程
+func sip002Plugin(node Node) (plugin, opts string, ok bool) {
+	o := node.PluginOpts
+	if o == nil {
+		o = &PluginOptions{}
+	}
+	switch node.Plugin {
+	case "obfs":
+		items := []string{"obfs=" + o.Mode}
+		if o.Host != "" {
+			items = append(items, "obfs-host="+o.Host)
+		}
+		return "obfs-local", strings.Join(items, ";"), true
+	case "v2ray-plugin":
+		items := []string{"mode=" + firstNonEmpty(o.Mode, "websocket")}
+		if o.TLS {
+			items = append(items, "tls")
+		}
+		if o.Host != "" {
+			items = append(items, "host="+o.Host)
+		}
+		if o.Path != "" {
+			items = append(items, "path="+o.Path)
+		}
+		if o.Mux != nil && !*o.Mux {
+			items = append(items, "mux=0")
+		}
+		return "v2ray-plugin", strings.Join(items, ";"), true
+	case "shadow-tls":
+		items := []string{"host=" + o.Host, "password=" + o.Password}
+		if o.Version != 0 {
+			items = append(items, "version="+strconv.Itoa(o.Version))
+		}
+		return "shadow-tls", strings.Join(items, ";"), true
+	case "restls":
+		items := []string{"host=" + o.Host, "password=" + o.Password}
+		if o.VersionHint != "" {
+			items = append(items, "version-hint="+o.VersionHint)
+		}
+		if o.RestlsScript != "" {
+			items = append(items, "restls-script="+o.RestlsScript)
+		}
+		return "restls", strings.Join(items, ";"), true
+	}
+	return "", "", false
+}
+
+// parseMbps 带宽可能是"100"或"100 Mbps"
+func parseMbps(s string) int {
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(s), "Mbps"))
+	if len(fields) == 0 {
+		return 0
+	}
+	mbps, _ := strconv.Atoi(fields[0])
+	return mbps
+}
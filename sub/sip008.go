@@ -0,0 +1,75 @@
+package sub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// SIP008 在线配置格式
+// See: https://shadowsocks.org/doc/sip008.html
+type SIP008 struct {
+	Version        int            `json:"version"`
+	Servers        []SIP008Server `json:"servers"`
+	BytesUsed      int            `json:"bytes_used,omitempty"`
+	BytesRemaining int            `json:"bytes_remaining,omitempty"`
+}
+
+type SIP008Server struct {
+	ID         string `json:"id"`
+	Remarks    string `json:"remarks"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+	Plugin     string `json:"plugin,omitempty"`
+	PluginOpts string `json:"plugin_opts,omitempty"`
+}
+
+// SSItem 转换为与ss://链接相同的结构, 复用插件的转换
+func (s SIP008Server) SSItem() SSItem {
+	item := SSItem{
+		Name:     s.Remarks,
+		Plugins:  make(map[string]string),
+		Server:   s.Server,
+		Port:     strconv.Itoa(s.ServerPort),
+		Password: s.Password,
+		Method:   s.Method,
+	}
+	if item.Name == "" {
+		item.Name = s.Server + ":" + item.Port
+	}
+	if s.Plugin != "" {
+		parsePluginOpts(item.Plugins, s.PluginOpts)
+		item.Plugins["plugin"] = s.Plugin
+	}
+	return item
+}
+
+// DataUsage 流量信息, 已用流量记为下载. 未提供流量信息时返回nil
+func (s SIP008) DataUsage() *ClashDataUsage {
+	if s.BytesUsed == 0 && s.BytesRemaining == 0 {
+		return nil
+	}
+	return &ClashDataUsage{
+		Download: s.BytesUsed,
+		Total:    s.BytesUsed + s.BytesRemaining,
+	}
+}
+
+// DecodeSIP008 解析SIP008格式的订阅, 同时返回其中的流量信息
+func DecodeSIP008(res *http.Response) ([]Node, *ClashDataUsage, error) {
+	var config SIP008
+	if err := json.NewDecoder(res.Body).Decode(&config); err != nil {
+		return nil, nil, err
+	}
+	if config.Version != 1 {
+		return nil, nil, fmt.Errorf("unsupported SIP008 version %d", config.Version)
+	}
+	var nodes []Node
+	for _, server := range config.Servers {
+		nodes = append(nodes, server.SSItem().Node())
+	}
+	return nodes, config.DataUsage(), nil
+}
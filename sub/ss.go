@@ -4,13 +4,15 @@ import (
 	"bytes"
 	"encoding/base64"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-var ssPattern = regexp.MustCompile("ss://(.*)")
+var ssPattern = regexp.MustCompile("(?i)^ss://(.*)")
 
 type SSItem struct {
 	Name     string
@@ -21,6 +23,98 @@ type SSItem struct {
 	Method   string
 }
 
+// Node 转换为Clash节点
+func (s SSItem) Node() Node {
+	node := Node{
+		Name:     s.Name,
+		Type:     "ss",
+		Server:   s.Server,
+		Port:     s.Port,
+		Cipher:   s.Method,
+		Password: s.Password,
+		TFO:      true,
+		UDP:      true,
+	}
+	node.Plugin, node.PluginOpts = SSPlugin(s.Plugins)
+	return node
+}
+
+// SSPlugin 将SIP002的插件参数转换为Clash的plugin和plugin-opts
+// plugins为SSItem.Plugins的格式, "plugin"键为插件名, 其余为插件参数
+// 不支持的插件返回空字符串, 节点将不带插件输出
+func SSPlugin(plugins map[string]string) (string, *PluginOptions) {
+	switch name := plugins["plugin"]; name {
+	case "":
+		return "", nil
+	case "simple-obfs", "obfs-local":
+		return "obfs", &PluginOptions{
+			Mode: plugins["obfs"],
+			Host: plugins["obfs-host"],
+		}
+	case "v2ray-plugin":
+		// 只支持websocket, quic模式Clash不支持
+		if mode := plugins["mode"]; mode != "" && mode != "websocket" {
+			log.Printf("unsupported v2ray-plugin mode %s", mode)
+			return "", nil
+		}
+		opts := &PluginOptions{
+			Mode:           "websocket",
+			Host:           plugins["host"],
+			Path:           plugins["path"],
+			TLS:            pluginBool(plugins, "tls"),
+			SkipCertVerify: pluginBool(plugins, "skip-cert-verify"),
+		}
+		// Clash默认开启mux, 只有明确给出时才输出
+		if _, ok := plugins["mux"]; ok {
+			mux := pluginBool(plugins, "mux")
+			opts.Mux = &mux
+		}
+		return "v2ray-plugin", opts
+	case "shadow-tls":
+		version, _ := strconv.Atoi(plugins["version"])
+		return "shadow-tls", &PluginOptions{
+			Host:     plugins["host"],
+			Password: plugins["password"],
+			Version:  version,
+		}
+	case "restls":
+		return "restls", &PluginOptions{
+			Host:         plugins["host"],
+			Password:     plugins["password"],
+			VersionHint:  plugins["version-hint"],
+			RestlsScript: plugins["restls-script"],
+		}
+	default:
+		log.Printf("unsupported ss plugin %s", name)
+		return "", nil
+	}
+}
+
+// parsePluginOpts 解析SIP002的插件参数, 如"v2ray-plugin;tls;host=a.com", 放入plugins
+// 没有值的参数是布尔开关, 值为空字符串, 见pluginBool
+func parsePluginOpts(plugins map[string]string, opts string) {
+	for _, p := range strings.Split(opts, ";") {
+		if p == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(p, "=")
+		plugins[k] = v
+	}
+}
+
+// pluginBool SIP002中布尔参数可以只写键名, 如"v2ray-plugin;tls;host=..."
+func pluginBool(plugins map[string]string, key string) bool {
+	v, ok := plugins[key]
+	if !ok {
+		return false
+	}
+	switch v {
+	case "", "1", "true":
+		return true
+	}
+	return false
+}
+
 func ssToClash(line []byte) (*SSItem, error) {
 	param := ssPattern.FindSubmatch(line)[1]
 	info := SSItem{
@@ -32,13 +126,11 @@ func ssToClash(line []byte) (*SSItem, error) {
 		param = param[:bytes.Index(param, []byte("#"))]
 	}
 
-	if bytes.Contains(param, []byte("/?")) {
-		plugin, _ := url.QueryUnescape(string(param[bytes.Index(param, []byte("/?"))+2:]))
-		param = param[:bytes.Index(param, []byte("/?"))]
-		for _, p := range strings.Split(plugin, ";") {
-			kv := strings.Split(p, "=")
-			info.Plugins[kv[0]] = kv[1]
-		}
+	// SIP002允许省略问号前的斜杠
+	if bytes.Contains(param, []byte("?")) {
+		plugin, _ := url.QueryUnescape(string(param[bytes.Index(param, []byte("?"))+1:]))
+		param = bytes.TrimSuffix(param[:bytes.Index(param, []byte("?"))], []byte("/"))
+		parsePluginOpts(info.Plugins, plugin)
 	}
 
 	if bytes.Contains(param, []byte("@")) {
@@ -51,8 +143,8 @@ func ssToClash(line []byte) (*SSItem, error) {
 			return &info, nil
 		}
 
-		// unpadded, avoid truncate password
-		param, _ = decodeBase64(param, base64.RawStdEncoding)
+		// SIP002规定为base64url, 但不少机场使用标准base64, 有无padding都有
+		param, _ = decodeBase64Lenient(param)
 		matcher = regexp.MustCompile("(.*?):(.*)").FindSubmatch(param)
 		if matcher != nil {
 			info.Method = string(matcher[1])
@@ -62,7 +154,7 @@ func ssToClash(line []byte) (*SSItem, error) {
 		}
 	} else {
 		// 需要再次解密一次
-		param, _ = decodeBase64(param, base64.StdEncoding)
+		param, _ = decodeBase64Lenient(param)
 		matcher := regexp.MustCompile("(.*?):(.*)@(.*):(.*)").FindSubmatch(param)
 		if matcher != nil {
 			info.Method = string(matcher[1])
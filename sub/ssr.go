@@ -32,21 +32,45 @@ type ClashDataUsage struct {
 func (c *ClashDataUsage) ParseResponse(r *http.Response) error {
 	userInfo := r.Header.Get("subscription-userinfo")
 	var upload, download, total int
-	match := regexp.MustCompile(`upload=(\d+); download=(\d+); total=(\d+); expire=(\d+)`).FindStringSubmatch(userInfo)
+	// 没有到期时间的订阅省略expire, 见Header
+	match := regexp.MustCompile(`upload=(\d+); download=(\d+); total=(\d+)(?:; expire=(\d+))?`).FindStringSubmatch(userInfo)
 	if len(match) != 5 {
 		return fmt.Errorf("invalid subscription-userinfo header")
 	}
 	upload, _ = strconv.Atoi(match[1])
 	download, _ = strconv.Atoi(match[2])
 	total, _ = strconv.Atoi(match[3])
-	expireUnix, _ := strconv.ParseInt(match[4], 10, 64)
 	c.Upload = upload
 	c.Download = download
 	c.Total = total
-	c.Expire = time.Unix(expireUnix, 0)
+	c.Expire = time.Time{}
+	if match[4] != "" {
+		expireUnix, _ := strconv.ParseInt(match[4], 10, 64)
+		c.Expire = time.Unix(expireUnix, 0)
+	}
 	return nil
 }
 
+// Add 累加另一个订阅的流量, 到期时间取较早的一个
+func (c *ClashDataUsage) Add(o *ClashDataUsage) {
+	c.Upload += o.Upload
+	c.Download += o.Download
+	c.Total += o.Total
+	if c.Expire.IsZero() || (!o.Expire.IsZero() && o.Expire.Before(c.Expire)) {
+		c.Expire = o.Expire
+	}
+}
+
+// Header 生成subscription-userinfo响应头, 是ParseResponse的逆过程
+// 没有到期时间时省略expire
+func (c *ClashDataUsage) Header() string {
+	header := fmt.Sprintf("upload=%d; download=%d; total=%d", c.Upload, c.Download, c.Total)
+	if !c.Expire.IsZero() {
+		header += fmt.Sprintf("; expire=%d", c.Expire.Unix())
+	}
+	return header
+}
+
 func (c *ClashDataUsage) String() string {
 	text := fmt.Sprintf(`已用：%.1fGB
 配额：%.1fGB
@@ -160,31 +184,95 @@ type SSRItem struct {
 	Group         string
 }
 
+// Node 转换为Clash节点
+func (s SSRItem) Node() Node {
+	return Node{
+		Name:          s.Remarks,
+		Type:          "ssr",
+		Server:        s.Server,
+		Port:          s.ServerPort,
+		Cipher:        s.Method,
+		Password:      s.Password,
+		Protocol:      s.Protocol,
+		ProtocolParam: s.ProtocolParam,
+		Obfs:          s.OBFS,
+		ObfsParam:     s.OBFSParam,
+		UDP:           true,
+	}
+}
+
 func decodeBase64(s []byte, encoding *base64.Encoding) ([]byte, error) {
 	var ds = make([]byte, encoding.DecodedLen(len(s)))
 	_, err := encoding.Decode(ds, s)
 	return ds, err
 }
 
-// apply decodeBase64 to string, panic on error
-func mustDecodeBase64(s string, encoding *base64.Encoding) string {
-	b, err := decodeBase64([]byte(s), encoding)
+// decodeBase64Lenient 依次尝试标准和URL安全编码, 有无padding均可
+// 各家机场对vmess等链接的编码方式并不统一
+func decodeBase64Lenient(s []byte) ([]byte, error) {
+	s = bytes.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+	s = bytes.TrimRight(s, "=")
+	var err error
+	for _, encoding := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+		var ds = make([]byte, encoding.DecodedLen(len(s)))
+		var n int
+		if n, err = encoding.Decode(ds, s); err == nil {
+			return ds[:n], nil
+		}
+	}
+	return nil, err
+}
+
+// subscriptionLines 读取订阅内容, 按行拆分并去除空行
+// 订阅一般是base64编码的, 也兼容直接返回明文链接的情况
+func subscriptionLines(res *http.Response) ([][]byte, error) {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	bodyDecoded, err := decodeBase64Lenient(body)
 	if err != nil {
-		panic(err)
+		if !schemePattern.Match(bytes.TrimSpace(body)) {
+			return nil, err
+		}
+		bodyDecoded = body
+	}
+	var lines [][]byte
+	for _, line := range bytes.Split(bodyDecoded, []byte{'\n'}) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
 	}
-	return string(b)
+	return lines, nil
 }
 
-// 全部params都是base64编码
+// 全部params都是base64编码, 有的机场带padding, 解码失败时返回错误, 由调用方跳过该节点
 func getParam(u string, item *SSRItem) error {
 	s, err := url.Parse(u)
 	if err != nil {
 		return err
 	}
 	q := s.Query()
-	item.OBFSParam = mustDecodeBase64(q.Get("obfsparam"), base64.RawURLEncoding)
-	item.ProtocolParam = mustDecodeBase64(q.Get("protoparam"), base64.RawURLEncoding)
-	item.Remarks = mustDecodeBase64(q.Get("remarks"), base64.RawURLEncoding)
-	item.Group = mustDecodeBase64(q.Get("group"), base64.RawURLEncoding)
+	for _, p := range []struct {
+		key string
+		dst *string
+	}{
+		{"obfsparam", &item.OBFSParam},
+		{"protoparam", &item.ProtocolParam},
+		{"remarks", &item.Remarks},
+		{"group", &item.Group},
+	} {
+		b, err := decodeBase64Lenient([]byte(q.Get(p.key)))
+		if err != nil {
+			return fmt.Errorf("ssr %s: %w", p.key, err)
+		}
+		*p.dst = string(b)
+	}
 	return nil
 }
@@ -0,0 +1,229 @@
+package sub
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RenderSurge 输出Surge 4/5配置
+// Surge不支持的节点(如ssr, vless)会被跳过, 并在[Proxy]中以注释列出
+// See: https://manual.nssurge.com/
+func RenderSurge(config ClashSub, out io.Writer) error {
+	w := bufio.NewWriter(out)
+	names := newNameSet()
+
+	w.WriteString("[General]\n")
+	w.WriteString("loglevel = notify\n")
+	w.WriteString("skip-proxy = 127.0.0.1, 192.168.0.0/16, 10.0.0.0/8, 172.16.0.0/12, localhost, *.local\n")
+	if config.MixedPort != 0 {
+		// Surge的http和socks5不能监听同一个端口, socks5使用下一个端口
+		w.WriteString("http-listen = 0.0.0.0:" + strconv.Itoa(config.MixedPort) + "\n")
+		w.WriteString("socks5-listen = 0.0.0.0:" + strconv.Itoa(config.MixedPort+1) + "\n")
+	}
+	w.WriteString("allow-wifi-access = " + strconv.FormatBool(config.AllowLan) + "\n")
+
+	w.WriteString("\n[Proxy]\n")
+	var (
+		skipped   []string
+		wireguard []Node
+	)
+	for _, node := range config.Proxies {
+		line, ok := surgeProxy(node)
+		if !ok {
+			skipped = append(skipped, node.Name)
+			continue
+		}
+		if node.Type == "wireguard" {
+			wireguard = append(wireguard, node)
+		}
+		names.add(node.Name)
+		w.WriteString(profileName(node.Name) + " = " + line + "\n")
+	}
+	writeSkipped(w, "#", skipped)
+
+	w.WriteString("\n[Proxy Group]\n")
+	for _, group := range supportedGroups(config.ProxyGroups, names, "select", "url-test", "fallback", "load-balance") {
+		items := []string{group.Type}
+		for _, proxy := range names.filter(group.Proxies) {
+			items = append(items, profileName(proxy))
+		}
+		if group.Type != "select" {
+			items = append(items, "url="+group.URL, "interval="+strconv.Itoa(group.Interval))
+			if group.Tolerance > 0 {
+				items = append(items, "tolerance="+strconv.Itoa(group.Tolerance))
+			}
+		}
+		w.WriteString(profileName(group.Name) + " = " + strings.Join(items, ", ") + "\n")
+	}
+
+	w.WriteString("\n[Rule]\n")
+	for _, r := range config.Rules {
+		ruleType, payload, target, options := r.Parts()
+		if !names.has(target) {
+			continue
+		}
+		target = profileName(target)
+		switch ruleType {
+		case "MATCH":
+			w.WriteString("FINAL," + target + "\n")
+		case "RULE-SET":
+			provider, ok := config.RuleProviders[payload]
+			if !ok {
+				continue
+			}
+			w.WriteString(strings.Join(append([]string{"RULE-SET", provider.URL, target}, options...), ",") + "\n")
+		case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD", "IP-CIDR", "IP-CIDR6", "GEOIP", "DST-PORT", "PROCESS-NAME":
+			w.WriteString(strings.Join(append([]string{ruleType, payload, target}, options...), ",") + "\n")
+		case "SRC-IP-CIDR":
+			w.WriteString(strings.Join([]string{"SRC-IP", payload, target}, ",") + "\n")
+		default:
+			log.Printf("surge: unsupported rule %s, skip", r)
+		}
+	}
+
+	if len(config.Hosts) > 0 {
+		w.WriteString("\n[Host]\n")
+		var domains []string
+		for domain := range config.Hosts {
+			domains = append(domains, domain)
+		}
+		sort.Strings(domains)
+		for _, domain := range domains {
+			w.WriteString(domain + " = " + config.Hosts[domain] + "\n")
+		}
+	}
+
+	for _, node := range wireguard {
+		w.WriteString("\n[WireGuard " + profileName(node.Name) + "]\n")
+		w.WriteString("private-key = " + node.PrivateKey + "\n")
+		if node.IP != "" {
+			w.WriteString("self-ip = " + node.IP + "\n")
+		}
+		if node.IPv6 != "" {
+			w.WriteString("self-ip-v6 = " + node.IPv6 + "\n")
+		}
+		if node.MTU != 0 {
+			w.WriteString("mtu = " + strconv.Itoa(node.MTU) + "\n")
+		}
+		peer := []string{
+			"public-key = " + node.PublicKey,
+			"endpoint = " + node.Server + ":" + node.Port,
+		}
+		if node.PreSharedKey != "" {
+			peer = append(peer, "preshared-key = "+node.PreSharedKey)
+		}
+		if len(node.Reserved) == 3 {
+			peer = append(peer, "client-id = "+joinInts(node.Reserved, "/"))
+		}
+		w.WriteString("peer = (" + strings.Join(peer, ", ") + ")\n")
+	}
+	return w.Flush()
+}
+
+func surgeProxy(node Node) (string, bool) {
+	items := []string{"", node.Server, node.Port}
+	tls := func() {
+		if sni := firstNonEmpty(node.SNI, node.ServerName); sni != "" {
+			items = append(items, "sni="+sni)
+		}
+		if node.SkipCertVerify {
+			items = append(items, "skip-cert-verify=true")
+		}
+	}
+	switch node.Type {
+	case "ss":
+		items[0] = "ss"
+		items = append(items, "encrypt-method="+node.Cipher, "password="+node.Password)
+		switch node.Plugin {
+		case "":
+		case "obfs":
+			if node.PluginOpts != nil {
+				items = append(items, "obfs="+node.PluginOpts.Mode)
+				if node.PluginOpts.Host != "" {
+					items = append(items, "obfs-host="+node.PluginOpts.Host)
+				}
+			}
+		case "shadow-tls":
+			if node.PluginOpts != nil {
+				items = append(items,
+					"shadow-tls-password="+node.PluginOpts.Password,
+					"shadow-tls-sni="+node.PluginOpts.Host,
+					"shadow-tls-version="+strconv.Itoa(node.PluginOpts.Version),
+				)
+			}
+		default:
+			return "", false
+		}
+	case "vmess":
+		items[0] = "vmess"
+		items = append(items, "username="+node.UUID)
+		if node.AlterID == nil || *node.AlterID == 0 {
+			items = append(items, "vmess-aead=true")
+		}
+		if node.TLS {
+			items = append(items, "tls=true")
+			tls()
+		}
+	case "trojan":
+		items[0] = "trojan"
+		items = append(items, "password="+node.Password)
+		tls()
+	case "hysteria2":
+		items[0] = "hysteria2"
+		items = append(items, "password="+node.Password)
+		if mbps := parseMbps(node.Down); mbps > 0 {
+			items = append(items, "download-bandwidth="+strconv.Itoa(mbps))
+		}
+		tls()
+	case "tuic":
+		items[0] = "tuic-v5"
+		items = append(items, "password="+node.Password, "uuid="+node.UUID)
+		if len(node.ALPN) > 0 {
+			items = append(items, "alpn="+node.ALPN[0])
+		}
+		tls()
+	case "wireguard":
+		return "wireguard, section-name=" + profileName(node.Name), true
+	case "http", "socks5":
+		items[0] = node.Type
+		if node.TLS {
+			items[0] += "s"
+			tls()
+		}
+	default:
+		return "", false
+	}
+	switch node.Network {
+	case "", "tcp":
+	case "ws":
+		items = append(items, "ws=true")
+		if node.WSOpts != nil {
+			items = append(items, "ws-path="+firstNonEmpty(node.WSOpts.Path, "/"))
+			if host := node.WSOpts.Headers["Host"]; host != "" {
+				items = append(items, "ws-headers=Host:"+host)
+			}
+		}
+	default:
+		// Surge只支持websocket传输
+		return "", false
+	}
+	if node.UDP && node.Type != "http" {
+		items = append(items, "udp-relay=true")
+	}
+	if node.TFO {
+		items = append(items, "tfo=true")
+	}
+	return strings.Join(items, ", "), true
+}
+
+func joinInts(ints []int, sep string) string {
+	var items []string
+	for _, i := range ints {
+		items = append(items, strconv.Itoa(i))
+	}
+	return strings.Join(items, sep)
+}
@@ -0,0 +1,105 @@
+package sub
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"strings"
+)
+
+// Target 输出格式, 由RewriteConfig或PassConfig生成的配置渲染而来
+type Target struct {
+	Render func(config ClashSub, out io.Writer) error
+	// Comment 行注释的前缀, 为空表示该格式不支持注释
+	Comment string
+}
+
+// Targets 可用的输出格式, 对应请求参数target
+var Targets = map[string]Target{
+	"clash":   {Render: RenderClash, Comment: "#"},
+	"meta":    {Render: RenderClashMeta, Comment: "#"},
+	"singbox": {Render: RenderSingBox},
+	"surge":   {Render: RenderSurge, Comment: "#"},
+	"quanx":   {Render: RenderQuantumultX, Comment: "#"},
+	"loon":    {Render: RenderLoon, Comment: "#"},
+	"uri":     {Render: RenderURI},
+}
+
+// Parts 拆分Clash规则, 如"IP-CIDR,10.0.0.0/8,DIRECT,no-resolve"
+// MATCH规则没有payload
+func (r Rule) Parts() (ruleType, payload, target string, options []string) {
+	items := strings.Split(r.String(), ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	ruleType = items[0]
+	switch {
+	case ruleType == "MATCH" && len(items) >= 2:
+		target = items[1]
+	case len(items) >= 3:
+		payload, target, options = items[1], items[2], items[3:]
+	}
+	return
+}
+
+// nameSet 记录输出中实际存在的节点和分组, 用于去掉对被跳过项的引用
+type nameSet map[string]bool
+
+func newNameSet() nameSet {
+	return nameSet{DIRECT: true, REJECT: true}
+}
+
+func (s nameSet) add(name string) {
+	s[name] = true
+}
+
+func (s nameSet) has(name string) bool {
+	return s[name]
+}
+
+// filter 去掉不存在的引用, 全部不存在时返回DIRECT, 避免输出空分组
+func (s nameSet) filter(names []string) []string {
+	var out []string
+	for _, name := range names {
+		if s[name] {
+			out = append(out, name)
+		}
+	}
+	if len(out) == 0 {
+		out = []string{DIRECT}
+	}
+	return out
+}
+
+// supportedGroups 过滤出目标格式支持的分组类型, 并将其名称加入names
+func supportedGroups(groups []ProxyGroup, names nameSet, types ...string) []ProxyGroup {
+	var out []ProxyGroup
+	for _, group := range groups {
+		supported := false
+		for _, t := range types {
+			supported = supported || group.Type == t
+		}
+		if !supported {
+			log.Printf("unsupported group %s (%s), skip", group.Name, group.Type)
+			continue
+		}
+		names.add(group.Name)
+		out = append(out, group)
+	}
+	return out
+}
+
+var profileNameReplacer = strings.NewReplacer(",", " ", "=", " ")
+
+// profileName 节点和分组名称中的逗号和等号在ini风格的配置中有特殊含义, 替换为空格
+func profileName(name string) string {
+	return profileNameReplacer.Replace(name)
+}
+
+// writeSkipped 以注释列出目标格式无法表示的节点
+func writeSkipped(w *bufio.Writer, comment string, skipped []string) {
+	if len(skipped) == 0 {
+		return
+	}
+	w.WriteString(comment + " unsupported nodes skipped: " + strings.Join(skipped, ", ") + "\n")
+}
@@ -0,0 +1,600 @@
+package sub
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/biter777/countries"
+	"gopkg.in/yaml.v3"
+)
+
+// 分组成员中的特殊引用
+const (
+	// MemberCountries 展开为全部生成的国家分组
+	MemberCountries = "@countries"
+	// MemberProxies 展开为上游订阅的全部节点
+	MemberProxies = "@proxies"
+	// MemberCountryPrefix 引用单个国家分组, 如"country:HK", 该国家分组被丢弃时引用一并去掉
+	MemberCountryPrefix = "country:"
+	// MemberFilterPrefix 展开为满足条件的上游节点, 条件同NodeFilter, 以&&连接,
+	// 如"@filter:country:HK && multiplier<=1", "@filter:line:IPLC|IEPL"
+	MemberFilterPrefix = "@filter:"
+)
+
+// Template 描述RewriteConfig生成的配置布局: 自定义节点, 分组, 规则和规则集
+// 内置的布局见default_template.yaml, config.yaml中的template会覆盖其中对应的字段
+type Template struct {
+	// Nodes 自定义节点, 追加在上游节点之后
+	Nodes []Node `yaml:"nodes,omitempty"`
+	// Countries 按国家分组的国家, 顺序即为国家分组的顺序
+	Countries []CountrySpec `yaml:"countries,omitempty"`
+	// Rename 按国家分组之前对上游节点的重命名, 按顺序执行
+	Rename []RenameStep `yaml:"rename,omitempty"`
+	// GeoOverrides 自定义的节点名到国家的匹配规则, 优先于内置规则
+	GeoOverrides []GeoOverride `yaml:"geo-overrides,omitempty"`
+	// MaxTestMultiplier 倍率高于此值的节点不放入url-test, fallback, load-balance分组, 0为不限制
+	MaxTestMultiplier float64 `yaml:"url-test-max-multiplier,omitempty"`
+	// CountryFormat 国家分组名的格式, 可用{emoji}, {code}, {name}, 缺省为{emoji}{code}
+	CountryFormat string `yaml:"country-format,omitempty"`
+	// CountryGroup 国家分组的类型和测速参数, countries中可按国家覆盖
+	CountryGroup GroupStrategy `yaml:"country-group,omitempty"`
+	// Groups 分组, 顺序即为输出顺序, 国家分组和流媒体分组排在最后
+	Groups []ProxyGroup `yaml:"groups,omitempty"`
+	// Media 流媒体分组, 请求参数media=true时才生成, 规则来自ACL4SSR
+	Media []MediaSpec `yaml:"media,omitempty"`
+	// RuleLists 规则列表, 按顺序输出, 同时作为/provider/rules/<name>对外提供
+	RuleLists []RuleList `yaml:"rule-lists,omitempty"`
+	// RuleProviders 规则集及其对应的分组, 排在规则列表之后
+	RuleProviders []RuleProviderBinding `yaml:"rule-providers,omitempty"`
+	// Rules 排在规则集之后的规则, 如GEOIP,CN,DIRECT
+	Rules []Rule `yaml:"rules,omitempty"`
+	// Final 漏网之鱼, 即MATCH规则的目标
+	Final string `yaml:"final"`
+	// General 覆盖NewSub中的全局设置, 格式同Clash配置, 如mixed-port, dns
+	General yaml.Node `yaml:"general,omitempty"`
+}
+
+type CountrySpec struct {
+	Code          string `yaml:"code"` // ISO 3166-1 alpha-2
+	Required      bool   `yaml:"required,omitempty"`
+	Name          string `yaml:"name,omitempty"` // 分组名, 缺省按country-format生成
+	GroupStrategy `yaml:",inline"`
+}
+
+// GroupStrategy 国家分组的类型, 未填写的字段沿用country-group, 如
+//
+//	{code: HK, type: url-test, tolerance: 50}
+//	{code: JP, type: load-balance, strategy: round-robin}
+//	{code: US, type: url-test, auto: true} 生成"🇺🇸US"(select)和嵌套其中的"🇺🇸US 自动"(url-test)
+type GroupStrategy struct {
+	Type      string `yaml:"type,omitempty"`     // select(缺省), url-test, fallback, load-balance
+	Strategy  string `yaml:"strategy,omitempty"` // load-balance: consistent-hashing(缺省), round-robin
+	URL       string `yaml:"url,omitempty"`      // 测速地址, 缺省为generate_204
+	Interval  int    `yaml:"interval,omitempty"` // 测速间隔, 秒, 缺省300
+	Tolerance int    `yaml:"tolerance,omitempty"`
+	Lazy      *bool  `yaml:"lazy,omitempty"`
+	// Auto 为true时国家分组为select, 成员为自动分组和全部节点, 自动分组的类型为Type, 缺省url-test
+	Auto *bool `yaml:"auto,omitempty"`
+	// AutoFormat 自动分组名, {group}为国家分组名, 缺省为"{group} 自动"
+	AutoFormat string `yaml:"auto-format,omitempty"`
+}
+
+const (
+	defaultTestURL      = "http://www.gstatic.com/generate_204"
+	defaultTestInterval = 300
+)
+
+// merge 未填写的字段取base中的值, strategy和tolerance只在合并后的类型用得到时才沿用
+func (s GroupStrategy) merge(base GroupStrategy) GroupStrategy {
+	s.Type = firstNonEmpty(s.Type, base.Type)
+	s.URL = firstNonEmpty(s.URL, base.URL)
+	s.AutoFormat = firstNonEmpty(s.AutoFormat, base.AutoFormat)
+	if s.Interval == 0 {
+		s.Interval = base.Interval
+	}
+	if s.Lazy == nil {
+		s.Lazy = base.Lazy
+	}
+	if s.Auto == nil {
+		s.Auto = base.Auto
+	}
+	if s.testType() == "load-balance" {
+		s.Strategy = firstNonEmpty(s.Strategy, base.Strategy)
+	}
+	if s.Tolerance == 0 && s.testType() == "url-test" {
+		s.Tolerance = base.Tolerance
+	}
+	return s
+}
+
+// testType 自动选择的分组的类型, 没有自动选择的分组时为空
+func (s GroupStrategy) testType() string {
+	if s.Type == "" || s.Type == "select" {
+		if isTrue(s.Auto) {
+			return "url-test"
+		}
+		return ""
+	}
+	return s.Type
+}
+
+func (s GroupStrategy) validate() error {
+	switch s.Type {
+	case "", "select", "url-test", "fallback", "load-balance":
+	default:
+		return fmt.Errorf("unsupported group type %q", s.Type)
+	}
+	switch s.Strategy {
+	case "", "consistent-hashing", "round-robin":
+	default:
+		return fmt.Errorf("unsupported load-balance strategy %q", s.Strategy)
+	}
+	if s.Strategy != "" && s.Type != "load-balance" {
+		return fmt.Errorf("strategy %q requires type load-balance", s.Strategy)
+	}
+	if isTrue(s.Auto) && s.Type == "select" {
+		return fmt.Errorf("auto group cannot be select")
+	}
+	return nil
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+// groups 生成名为name的国家分组, auto时第一个为select分组, 第二个为嵌套其中的自动分组
+func (s GroupStrategy) groups(name string, members []string) []ProxyGroup {
+	if s.testType() == "" {
+		return []ProxyGroup{{Name: name, Type: "select", Proxies: members}}
+	}
+	auto := ProxyGroup{
+		Name:      name,
+		Type:      s.testType(),
+		Proxies:   members,
+		URL:       firstNonEmpty(s.URL, defaultTestURL),
+		Interval:  s.Interval,
+		Tolerance: s.Tolerance,
+		Lazy:      s.Lazy,
+		Strategy:  s.Strategy,
+	}
+	if auto.Interval == 0 {
+		auto.Interval = defaultTestInterval
+	}
+	if auto.Type == "load-balance" && auto.Strategy == "" {
+		auto.Strategy = "consistent-hashing"
+	}
+	if auto.Type != "url-test" {
+		auto.Tolerance = 0
+	}
+	if !isTrue(s.Auto) {
+		return []ProxyGroup{auto}
+	}
+	auto.Name = strings.ReplaceAll(firstNonEmpty(s.AutoFormat, "{group} 自动"), "{group}", name)
+	manual := ProxyGroup{Name: name, Type: "select", Proxies: append([]string{auto.Name}, members...)}
+	return []ProxyGroup{manual, auto}
+}
+
+// ParseCountries 解析请求参数中的国家列表, 如"HK,JP,SG!,US", 以!结尾的为Required
+func ParseCountries(s string) ([]CountrySpec, error) {
+	var (
+		specs []CountrySpec
+		seen  = make(map[string]bool)
+	)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		spec := CountrySpec{Code: strings.TrimSuffix(item, "!"), Required: strings.HasSuffix(item, "!")}
+		if !validCountry(spec.Code) {
+			return nil, fmt.Errorf("unknown country %q", spec.Code)
+		}
+		spec.Code = countries.ByName(spec.Code).Alpha2()
+		if seen[spec.Code] {
+			return nil, fmt.Errorf("duplicate country %q", spec.Code)
+		}
+		seen[spec.Code] = true
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+type MediaSpec struct {
+	Name      string   `yaml:"name"`      // 分组名
+	Key       string   `yaml:"key"`       // ACL4SSR规则碎片的名称, 如Netflix
+	Countries []string `yaml:"countries"` // 可选的国家分组
+}
+
+type RuleList struct {
+	Name  string `yaml:"name"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// RuleProviderBinding 规则集, Policy为空时只声明规则集而不生成RULE-SET规则
+type RuleProviderBinding struct {
+	Name         string `yaml:"name"`
+	RuleProvider `yaml:",inline"`
+	Policy       string `yaml:"policy,omitempty"`
+}
+
+//go:embed default_template.yaml
+var defaultTemplate []byte
+
+// DefaultTemplate 内置的布局, 每次调用返回新的副本
+func DefaultTemplate() *Template {
+	t, err := ParseTemplate(defaultTemplate, nil)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// ParseTemplate 解析YAML格式的布局, base不为nil时在其副本上覆盖, 未出现的字段保留base中的值
+func ParseTemplate(b []byte, base *Template) (*Template, error) {
+	var t Template
+	if base != nil {
+		t = base.clone()
+	}
+	if err := yaml.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	if err := t.CountryGroup.validate(); err != nil {
+		return nil, fmt.Errorf("template: country-group: %w", err)
+	}
+	for _, c := range t.Countries {
+		if !validCountry(c.Code) {
+			return nil, fmt.Errorf("template: unknown country %q", c.Code)
+		}
+		if err := c.GroupStrategy.merge(t.CountryGroup).validate(); err != nil {
+			return nil, fmt.Errorf("template: country %s: %w", c.Code, err)
+		}
+	}
+	if _, err := NewGeoMatcher(t.GeoOverrides); err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	if _, err := compileRenameSteps(t.Rename); err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	return &t, nil
+}
+
+// clone 通过YAML深拷贝, 避免覆盖时修改base
+func (t *Template) clone() Template {
+	b, err := yaml.Marshal(t)
+	if err != nil {
+		panic(err)
+	}
+	var c Template
+	if err = yaml.Unmarshal(b, &c); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// GeoMatcher 带有布局中自定义规则的国家识别
+func (t *Template) GeoMatcher() *GeoMatcher {
+	geo, err := NewGeoMatcher(t.GeoOverrides)
+	if err != nil {
+		log.Printf("ignore geo overrides: %v", err)
+		return defaultGeoMatcher
+	}
+	return geo
+}
+
+// RenameNodes 按布局中的rename重命名上游节点, 正则已在ParseTemplate中检查过
+func (t *Template) RenameNodes(remote ClashSub, geo *GeoMatcher) ClashSub {
+	renamed, err := RenameNodes(remote, t.Rename, geo)
+	if err != nil {
+		log.Printf("ignore rename: %v", err)
+		return remote
+	}
+	return renamed
+}
+
+// excludeExpensive 自动选择的分组中去掉倍率过高的节点, 分组等其他成员不受影响
+func (t *Template) excludeExpensive(g ProxyGroup, members []string, nodes []Node) []string {
+	if t.MaxTestMultiplier <= 0 || g.Type == "select" || g.Type == "relay" {
+		return members
+	}
+	expensive := make(map[string]bool)
+	for _, node := range nodes {
+		if node.Metadata().Multiplier > t.MaxTestMultiplier {
+			expensive[node.Name] = true
+		}
+	}
+	var out []string
+	for _, m := range members {
+		if !expensive[m] {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// RuleList 按名称查找规则列表
+func (t *Template) RuleList(name string) ([]Rule, bool) {
+	for _, l := range t.RuleLists {
+		if l.Name == name {
+			return l.Rules, true
+		}
+	}
+	return nil, false
+}
+
+// WithCountries 返回替换了国家列表的副本, 布局中已有的国家沿用其分组名和分组类型
+func (t *Template) WithCountries(specs []CountrySpec) *Template {
+	c := t.clone()
+	existing := make(map[countries.CountryCode]CountrySpec)
+	for _, spec := range t.Countries {
+		existing[countries.ByName(spec.Code)] = spec
+	}
+	c.Countries = nil
+	for _, spec := range specs {
+		old := existing[countries.ByName(spec.Code)]
+		spec.Name = firstNonEmpty(spec.Name, old.Name)
+		spec.GroupStrategy = spec.GroupStrategy.merge(old.GroupStrategy)
+		c.Countries = append(c.Countries, spec)
+	}
+	return &c
+}
+
+// countryNeed 需要生成分组的国家及其优先级, 分组名和分组类型
+type countryNeed struct {
+	countries.CountryCode
+	priority
+	name     string
+	strategy GroupStrategy
+}
+
+func (t *Template) countriesNeeded() []countryNeed {
+	var needed []countryNeed
+	for _, c := range t.Countries {
+		p := Optional
+		if c.Required {
+			p = Required
+		}
+		code := countries.ByName(c.Code)
+		name := c.Name
+		if name == "" {
+			name = formatCountryGroup(t.CountryFormat, code)
+		}
+		needed = append(needed, countryNeed{code, p, name, c.GroupStrategy.merge(t.CountryGroup)})
+	}
+	return needed
+}
+
+func formatCountryGroup(format string, c countries.CountryCode) string {
+	if format == "" {
+		return countryGroup(c)
+	}
+	return strings.NewReplacer(
+		"{emoji}", c.Emoji(),
+		"{code}", c.Alpha2(),
+		"{name}", c.String(),
+	).Replace(format)
+}
+
+// memberResolver 展开分组成员中的特殊引用
+type memberResolver struct {
+	nodes         []Node
+	geo           *GeoMatcher
+	countryGroups map[countries.CountryCode]string
+	countryOrder  []string
+}
+
+func (r *memberResolver) resolve(members []string) []string {
+	var out []string
+	for _, m := range members {
+		switch {
+		case m == MemberCountries:
+			out = append(out, r.countryOrder...)
+		case m == MemberProxies:
+			for _, node := range r.nodes {
+				out = append(out, node.Name)
+			}
+		case strings.HasPrefix(m, MemberCountryPrefix):
+			if name, ok := r.countryGroups[countries.ByName(strings.TrimPrefix(m, MemberCountryPrefix))]; ok {
+				out = append(out, name)
+			}
+		case strings.HasPrefix(m, MemberFilterPrefix):
+			f, err := parseMemberFilter(m)
+			if err != nil {
+				log.Printf("ignore member %s: %v", m, err)
+				continue
+			}
+			for _, node := range f.Apply(r.nodes, r.geo) {
+				out = append(out, node.Name)
+			}
+		default:
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// parseMemberFilter 解析"@filter:country:HK && multiplier<=1", 各项都满足的节点才算
+func parseMemberFilter(m string) (*NodeFilter, error) {
+	f, err := ParseNodeFilter(strings.Split(strings.TrimPrefix(m, MemberFilterPrefix), "&&"), nil)
+	if err == nil && f == nil {
+		err = fmt.Errorf("empty filter")
+	}
+	return f, err
+}
+
+// Rewrite 按布局重新分组并加上自定义的分组和规则
+// emptyPolicy决定没有节点的可选国家如何处理: drop(默认)丢弃, placeholder放一个DIRECT
+func (t *Template) Rewrite(remote ClashSub, emptyPolicy string, ruleStreamMedia bool, proc ...Processor) ClashSub {
+	if emptyPolicy == "" {
+		emptyPolicy = "drop"
+	}
+	geo := t.GeoMatcher()
+	// 倍率等信息在重命名之前解析, 以免被rename去掉
+	remote.Proxies = AnnotateNodes(remote.Proxies)
+	remote = t.RenameNodes(remote, geo)
+	needed := t.countriesNeeded()
+	countryGroups, countryNames := groupByCountries(remote, geo, needed, emptyPolicy)
+	resolver := &memberResolver{nodes: remote.Proxies, geo: geo, countryGroups: countryNames}
+	// 嵌套的自动分组不出现在@countries中
+	for _, c := range needed {
+		if name, ok := countryNames[c.CountryCode]; ok {
+			resolver.countryOrder = append(resolver.countryOrder, name)
+		}
+	}
+	withMembers := func(g ProxyGroup, members []string) ProxyGroup {
+		g.Proxies = t.excludeExpensive(g, members, remote.Proxies)
+		if len(g.Proxies) == 0 && len(g.Use) == 0 {
+			log.Printf("group %s has no members, put a DIRECT here", g.Name)
+			g.Proxies = []string{DIRECT}
+		}
+		return g
+	}
+	resolve := func(g ProxyGroup) ProxyGroup {
+		g = withMembers(g, resolver.resolve(g.Proxies))
+		// relay引用的国家分组被丢弃后不足两跳, 改为select, 不输出无效的relay
+		if g.Type == "relay" && len(g.Proxies) < 2 {
+			log.Printf("relay group %s has less than 2 proxies, use select instead", g.Name)
+			g.Type = "select"
+		}
+		return g
+	}
+	for i, g := range countryGroups {
+		countryGroups[i] = withMembers(g, g.Proxies)
+	}
+
+	/* PROXY GROUPS */
+	var proxyGroups []ProxyGroup
+	for _, g := range t.Groups {
+		proxyGroups = append(proxyGroups, resolve(g))
+	}
+
+	/* RULES */
+	var rules []Rule
+	for _, l := range t.RuleLists {
+		rules = append(rules, l.Rules...)
+	}
+
+	/* 流媒体 */
+	// could be slow if server cannot access Github properly
+	if ruleStreamMedia {
+		for _, m := range t.Media {
+			g := ProxyGroup{Name: m.Name, Type: "select", Proxies: []string{DIRECT}}
+			for _, c := range m.Countries {
+				g.Proxies = append(g.Proxies, MemberCountryPrefix+c)
+			}
+			proxyGroups = append(proxyGroups, resolve(g))
+			rules = append(rules, acl4ssrClashRules(m.Key, m.Name)...)
+		}
+	}
+
+	proxyGroups = append(proxyGroups, countryGroups...)
+
+	/* RULE PROVIDERS */
+	ruleProviders := make(map[string]RuleProvider)
+	for _, p := range t.RuleProviders {
+		ruleProviders[p.Name] = p.RuleProvider
+		if p.Policy != "" {
+			rules = append(rules, Rule("RULE-SET,"+p.Name+","+p.Policy))
+		}
+	}
+	rules = append(rules, t.Rules...)
+
+	config := NewSub()
+	if !t.General.IsZero() {
+		if err := t.General.Decode(&config); err != nil {
+			log.Printf("cannot apply general settings: %v", err)
+		}
+	}
+	config.ProxyGroups = proxyGroups
+	config.Rules = rules
+	config.Proxies = append(remote.Proxies, t.Nodes...)
+	config.RuleProviders = ruleProviders
+
+	for i := range proc {
+		proc[i](&config)
+	}
+
+	// 漏网之鱼
+	config.Rules = append(config.Rules, Rule("MATCH,"+t.Final))
+	return config
+}
+
+// Validate 检查布局能否生成完整的配置: 国家代码必须有效,
+// 所有国家分组都保留时, 分组成员和规则指向的分组或节点必须存在
+// 引用了countries以外的国家不算错误, 生成时和被丢弃的国家分组一样去掉
+func (t *Template) Validate() error {
+	if !t.General.IsZero() {
+		var general ClashSub
+		if err := t.General.Decode(&general); err != nil {
+			return fmt.Errorf("general: %w", err)
+		}
+	}
+	for _, g := range t.Groups {
+		if g.Type == "relay" && len(g.Proxies) < 2 {
+			return fmt.Errorf("relay group %s: needs at least 2 proxies", g.Name)
+		}
+		for _, m := range g.Proxies {
+			if code := strings.TrimPrefix(m, MemberCountryPrefix); code != m && !validCountry(code) {
+				return fmt.Errorf("group %s: unknown country %s", g.Name, code)
+			}
+			if strings.HasPrefix(m, MemberFilterPrefix) {
+				if _, err := parseMemberFilter(m); err != nil {
+					return fmt.Errorf("group %s: %s: %w", g.Name, m, err)
+				}
+			}
+		}
+	}
+	for _, m := range t.Media {
+		for _, code := range m.Countries {
+			if !validCountry(code) {
+				return fmt.Errorf("media %s: unknown country %s", m.Name, code)
+			}
+		}
+	}
+	// 每个国家放一个占位节点, 使所有国家分组都保留; media的规则需要联网获取, 这里只检查分组
+	var remote ClashSub
+	for _, c := range t.Countries {
+		remote.Proxies = append(remote.Proxies, Node{Name: countries.ByName(c.Code).Alpha2(), Type: "direct"})
+	}
+	return checkReferences(t.Rewrite(remote, "placeholder", false))
+}
+
+func validCountry(code string) bool {
+	cc := countries.ByName(code)
+	return cc != countries.Unknown && len(cc.Alpha2()) == 2
+}
+
+// checkReferences 检查分组成员, dialer-proxy和规则的目标是否都存在, 以及链式代理没有环路
+func checkReferences(config ClashSub) error {
+	names := newNameSet()
+	for _, node := range config.Proxies {
+		names.add(node.Name)
+	}
+	for _, g := range config.ProxyGroups {
+		if names.has(g.Name) {
+			return fmt.Errorf("duplicate group or node name %s", g.Name)
+		}
+		names.add(g.Name)
+	}
+	for _, g := range config.ProxyGroups {
+		for _, m := range g.Proxies {
+			if !names.has(m) {
+				return fmt.Errorf("group %s: unknown member %s", g.Name, m)
+			}
+		}
+	}
+	if err := checkChains(config, names); err != nil {
+		return err
+	}
+	for _, r := range config.Rules {
+		ruleType, payload, target, _ := r.Parts()
+		if target == "" || !names.has(target) {
+			return fmt.Errorf("rule %s: unknown target %s", r, target)
+		}
+		if _, ok := config.RuleProviders[payload]; ruleType == "RULE-SET" && !ok {
+			return fmt.Errorf("rule %s: unknown rule provider %s", r, payload)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package sub
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+var trojanPattern = regexp.MustCompile("(?i)^trojan://(.*)")
+
+// trojanToClash 解析trojan-go风格的分享链接
+// trojan://password@host:port?sni=...&type=ws&host=...&path=...&allowInsecure=1#name
+func trojanToClash(line []byte) (*Node, error) {
+	u, err := parseShareLink(line)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	node := Node{
+		Name:           u.Fragment,
+		Type:           "trojan",
+		Server:         u.Hostname(),
+		Port:           u.Port(),
+		Password:       u.User.Username(),
+		SNI:            firstNonEmpty(q.Get("sni"), q.Get("peer")),
+		ALPN:           splitNonEmpty(q.Get("alpn"), ","),
+		SkipCertVerify: queryBool(q, "allowInsecure"),
+		UDP:            true,
+	}
+	if err = applyTransport(&node, q); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// DecodeTrojan 解析trojan订阅, 每行为trojan://链接
+func DecodeTrojan(res *http.Response) ([]Node, error) {
+	return decodeShareLinks(res, trojanPattern, trojanToClash)
+}
+
+// parseShareLink 解析scheme://userinfo@host:port?query#name形式的链接
+func parseShareLink(line []byte) (*url.URL, error) {
+	u, err := url.Parse(string(line))
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("invalid %s link: missing credential, host or port", u.Scheme)
+	}
+	if u.Fragment == "" {
+		u.Fragment = u.Host
+	}
+	return u, nil
+}
+
+// applyTransport 按type参数设置传输层, trojan和vless共用同一套参数, Clash的trojan只支持ws和grpc
+func applyTransport(node *Node, q url.Values) error {
+	switch network := q.Get("type"); network {
+	case "", "tcp", "original":
+	case "ws":
+		node.Network = "ws"
+		node.WSOpts = &WSOptions{Path: firstNonEmpty(q.Get("path"), "/")}
+		if host := q.Get("host"); host != "" {
+			node.WSOpts.Headers = map[string]string{"Host": host}
+		}
+	case "grpc":
+		node.Network = "grpc"
+		node.GrpcOpts = &GrpcOptions{GrpcServiceName: q.Get("serviceName")}
+	case "h2", "http":
+		if node.Type == "trojan" {
+			return fmt.Errorf("unsupported %s network %q", node.Type, network)
+		}
+		node.Network = "h2"
+		node.H2Opts = &H2Options{
+			Host: splitNonEmpty(q.Get("host"), ","),
+			Path: firstNonEmpty(q.Get("path"), "/"),
+		}
+	default:
+		return fmt.Errorf("unsupported %s network %q", node.Type, network)
+	}
+	return nil
+}
+
+func queryBool(q url.Values, key string) bool {
+	switch q.Get(key) {
+	case "1", "true":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+package sub
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Format 上游订阅的格式
+type Format string
+
+const (
+	FormatClash   Format = "clash"   // Clash YAML配置
+	FormatURIList Format = "uri"     // 分享链接列表, base64编码或明文
+	FormatSIP008  Format = "sip008"  // SIP008 JSON
+	FormatUnknown Format = "unknown" // 无法识别
+)
+
+var schemePattern = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*)://`)
+
+// uriParsers 按scheme分发的单行解析函数
+var uriParsers = map[string]func(line []byte) (*Node, error){
+	"ss": func(line []byte) (*Node, error) {
+		item, err := ssToClash(line)
+		if err != nil {
+			return nil, err
+		}
+		node := item.Node()
+		return &node, nil
+	},
+	"ssr": func(line []byte) (*Node, error) {
+		item, err := ssrToClash(line)
+		if err != nil {
+			return nil, err
+		}
+		node := item.Node()
+		return &node, nil
+	},
+	"vmess":     vmessToClash,
+	"trojan":    trojanToClash,
+	"vless":     vlessToClash,
+	"hysteria":  hysteriaToClash,
+	"hysteria2": hysteria2ToClash,
+	"hy2":       hysteria2ToClash,
+	"tuic":      tuicToClash,
+	"wireguard": wireguardToClash,
+	"wg":        wireguardToClash,
+}
+
+// DecodeURIList 解析混合了多种协议的订阅, 逐行按scheme分发给对应的解析函数
+// 订阅内容可以是base64编码的, 也可以是明文. 无法识别或解析失败的行会被跳过并打印日志,
+// 避免个别节点拖垮整个订阅
+func DecodeURIList(res *http.Response) ([]Node, error) {
+	lines, err := subscriptionLines(res)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	for _, line := range lines {
+		match := schemePattern.FindSubmatch(line)
+		if match == nil {
+			continue
+		}
+		parse, ok := uriParsers[strings.ToLower(string(match[1]))]
+		if !ok {
+			log.Printf("unsupported scheme %s, skip", match[1])
+			continue
+		}
+		node, err := parse(line)
+		if err != nil {
+			log.Printf("cannot parse %s link: %v", match[1], err)
+			continue
+		}
+		nodes = append(nodes, *node)
+	}
+	return nodes, nil
+}
+
+// decodeShareLinks 解析单一协议的订阅, 只处理以pattern的scheme开头的行,
+// 与DecodeURIList一样, 解析失败的行会被跳过并打印日志
+func decodeShareLinks(res *http.Response, pattern *regexp.Regexp, parse func(line []byte) (*Node, error)) ([]Node, error) {
+	lines, err := subscriptionLines(res)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	for _, line := range lines {
+		if !pattern.Match(line) {
+			continue
+		}
+		node, err := parse(line)
+		if err != nil {
+			log.Printf("cannot parse %s link: %v", schemePattern.FindSubmatch(line)[1], err)
+			continue
+		}
+		nodes = append(nodes, *node)
+	}
+	return nodes, nil
+}
+
+// SniffFormat 根据订阅内容判断其格式
+func SniffFormat(body []byte) Format {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return FormatUnknown
+	}
+	if body[0] == '{' {
+		var probe struct {
+			Servers json.RawMessage `json:"servers"`
+		}
+		if json.Unmarshal(body, &probe) == nil && probe.Servers != nil {
+			return FormatSIP008
+		}
+		return FormatUnknown
+	}
+	if schemePattern.Match(body) {
+		return FormatURIList
+	}
+	if decoded, err := decodeBase64Lenient(body); err == nil && schemePattern.Match(bytes.TrimSpace(decoded)) {
+		return FormatURIList
+	}
+	return FormatClash
+}
+
+// EncodeURI 将节点编码为分享链接, 是DecodeURIList的逆过程
+// 支持ss(SIP002), ssr, vmess(v2rayN), trojan, 其他类型返回false
+func EncodeURI(node Node) (string, bool) {
+	hostPort := net.JoinHostPort(node.Server, node.Port)
+	switch node.Type {
+	case "ss":
+		link := "ss://" + base64.RawURLEncoding.EncodeToString([]byte(node.Cipher+":"+node.Password)) + "@" + hostPort
+		if node.Plugin != "" {
+			plugin, opts, ok := sip002Plugin(node)
+			if !ok {
+				return "", false
+			}
+			link += "/?plugin=" + url.QueryEscape(plugin+";"+opts)
+		}
+		return link + "#" + escapeName(node.Name), true
+	case "ssr":
+		params := url.Values{}
+		params.Set("obfsparam", base64.RawURLEncoding.EncodeToString([]byte(node.ObfsParam)))
+		params.Set("protoparam", base64.RawURLEncoding.EncodeToString([]byte(node.ProtocolParam)))
+		params.Set("remarks", base64.RawURLEncoding.EncodeToString([]byte(node.Name)))
+		params.Set("group", "")
+		link := strings.Join([]string{
+			node.Server,
+			node.Port,
+			node.Protocol,
+			node.Cipher,
+			node.Obfs,
+			base64.RawURLEncoding.EncodeToString([]byte(node.Password)),
+		}, ":") + "/?" + params.Encode()
+		return "ssr://" + base64.RawURLEncoding.EncodeToString([]byte(link)), true
+	case "vmess":
+		link := VMessLink{
+			Version:  "2",
+			Remarks:  node.Name,
+			Address:  node.Server,
+			Port:     jsonString(node.Port),
+			ID:       node.UUID,
+			AlterID:  "0",
+			Security: node.Cipher,
+			Network:  "tcp",
+			Type:     "none",
+			SNI:      node.ServerName,
+			ALPN:     strings.Join(node.ALPN, ","),
+		}
+		if node.AlterID != nil {
+			link.AlterID = jsonString(strconv.Itoa(*node.AlterID))
+		}
+		if node.TLS {
+			link.TLS = "tls"
+		}
+		switch node.Network {
+		case "", "tcp":
+		case "http":
+			link.Type = "http"
+			if node.HTTPOpts != nil {
+				link.Host = strings.Join(node.HTTPOpts.Headers["Host"], ",")
+				link.Path = strings.Join(node.HTTPOpts.Path, ",")
+			}
+		case "ws":
+			link.Network = "ws"
+			if node.WSOpts != nil {
+				link.Host = node.WSOpts.Headers["Host"]
+				link.Path = node.WSOpts.Path
+			}
+		case "h2":
+			link.Network = "h2"
+			if node.H2Opts != nil {
+				link.Host = strings.Join(node.H2Opts.Host, ",")
+				link.Path = node.H2Opts.Path
+			}
+		case "grpc":
+			link.Network = "grpc"
+			if node.GrpcOpts != nil {
+				link.Path = node.GrpcOpts.GrpcServiceName
+			}
+		default:
+			return "", false
+		}
+		payload, err := json.Marshal(link)
+		if err != nil {
+			return "", false
+		}
+		return "vmess://" + base64.StdEncoding.EncodeToString(payload), true
+	case "trojan":
+		q := url.Values{}
+		if node.SNI != "" {
+			q.Set("sni", node.SNI)
+		}
+		if len(node.ALPN) > 0 {
+			q.Set("alpn", strings.Join(node.ALPN, ","))
+		}
+		if node.SkipCertVerify {
+			q.Set("allowInsecure", "1")
+		}
+		switch node.Network {
+		case "", "tcp":
+		case "ws":
+			q.Set("type", "ws")
+			if node.WSOpts != nil {
+				q.Set("path", node.WSOpts.Path)
+				if host := node.WSOpts.Headers["Host"]; host != "" {
+					q.Set("host", host)
+				}
+			}
+		case "grpc":
+			q.Set("type", "grpc")
+			if node.GrpcOpts != nil {
+				q.Set("serviceName", node.GrpcOpts.GrpcServiceName)
+			}
+		case "h2":
+			q.Set("type", "h2")
+			if node.H2Opts != nil {
+				q.Set("host", strings.Join(node.H2Opts.Host, ","))
+				q.Set("path", node.H2Opts.Path)
+			}
+		default:
+			return "", false
+		}
+		u := url.URL{
+			Scheme:   "trojan",
+			User:     url.User(node.Password),
+			Host:     hostPort,
+			RawQuery: q.Encode(),
+		}
+		return u.String() + "#" + escapeName(node.Name), true
+	}
+	return "", false
+}
+
+// escapeName 节点名用%20而不是+表示空格, 各家客户端都能正确解析
+func escapeName(name string) string {
+	return strings.ReplaceAll(url.QueryEscape(name), "+", "%20")
+}
+
+// RenderURI 输出base64编码的分享链接订阅, 供Shadowrocket, v2rayN等客户端使用
+// 无法编码的节点会被跳过
+func RenderURI(config ClashSub, out io.Writer) error {
+	var links []string
+	for _, node := range config.Proxies {
+		link, ok := EncodeURI(node)
+		if !ok {
+			log.Printf("cannot encode %s (%s) as share link, skip", node.Name, node.Type)
+			continue
+		}
+		links = append(links, link)
+	}
+	_, err := io.WriteString(out, base64.StdEncoding.EncodeToString([]byte(strings.Join(links, "\n"))))
+	return err
+}
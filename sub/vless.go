@@ -0,0 +1,57 @@
+package sub
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+var vlessPattern = regexp.MustCompile("(?i)^vless://(.*)")
+
+// vlessToClash 解析vless分享链接, 输出仅Clash.Meta(mihomo)支持
+// vless://uuid@host:port?security=reality&sni=...&pbk=...&sid=...&flow=xtls-rprx-vision&fp=chrome#name
+func vlessToClash(line []byte) (*Node, error) {
+	u, err := parseShareLink(line)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	node := Node{
+		Name:              u.Fragment,
+		Type:              "vless",
+		Server:            u.Hostname(),
+		Port:              u.Port(),
+		UUID:              u.User.Username(),
+		Flow:              q.Get("flow"),
+		ServerName:        firstNonEmpty(q.Get("sni"), q.Get("peer")),
+		ALPN:              splitNonEmpty(q.Get("alpn"), ","),
+		ClientFingerprint: q.Get("fp"),
+		SkipCertVerify:    queryBool(q, "allowInsecure"),
+		UDP:               true,
+	}
+	switch security := q.Get("security"); security {
+	case "", "none":
+	case "tls", "xtls":
+		node.TLS = true
+	case "reality":
+		node.TLS = true
+		if q.Get("pbk") == "" {
+			return nil, fmt.Errorf("invalid vless link: reality without pbk")
+		}
+		node.RealityOpts = &RealityOptions{
+			PublicKey: q.Get("pbk"),
+			ShortID:   q.Get("sid"),
+		}
+	default:
+		return nil, fmt.Errorf("unsupported vless security %q", security)
+	}
+	if err = applyTransport(&node, q); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// DecodeVLESS 解析vless订阅, 每行为vless://链接
+func DecodeVLESS(res *http.Response) ([]Node, error) {
+	return decodeShareLinks(res, vlessPattern, vlessToClash)
+}
@@ -0,0 +1,142 @@
+package sub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var vmessPattern = regexp.MustCompile("(?i)^vmess://(.*)")
+
+// VMessLink v2rayN格式的分享链接, vmess://后为JSON的base64编码
+// See: https://github.com/2dust/v2rayN/wiki/分享链接格式说明(ver-2)
+type VMessLink struct {
+	Version  jsonString `json:"v"`
+	Remarks  string     `json:"ps"`
+	Address  string     `json:"add"`
+	Port     jsonString `json:"port"`
+	ID       string     `json:"id"`
+	AlterID  jsonString `json:"aid"`
+	Security string     `json:"scy"`
+	Network  string     `json:"net"`
+	Type     string     `json:"type"`
+	Host     string     `json:"host"`
+	Path     string     `json:"path"`
+	TLS      string     `json:"tls"`
+	SNI      string     `json:"sni"`
+	ALPN     string     `json:"alpn"`
+}
+
+// jsonString 兼容数字和字符串两种写法, 不同机场对port和aid的处理不一致
+type jsonString string
+
+func (s *jsonString) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var v string
+		if err := json.Unmarshal(b, &v); err != nil {
+			return err
+		}
+		*s = jsonString(v)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*s = jsonString(n.String())
+	return nil
+}
+
+func vmessToClash(line []byte) (*Node, error) {
+	payload, err := decodeBase64Lenient(vmessPattern.FindSubmatch(line)[1])
+	if err != nil {
+		return nil, err
+	}
+	var link VMessLink
+	if err = json.Unmarshal(payload, &link); err != nil {
+		return nil, fmt.Errorf("invalid vmess link: %w", err)
+	}
+	return link.Node()
+}
+
+// Node 将分享链接转换为Clash节点
+func (v VMessLink) Node() (*Node, error) {
+	if v.Address == "" || v.Port == "" || v.ID == "" {
+		return nil, fmt.Errorf("invalid vmess link: missing add, port or id")
+	}
+	alterID, _ := strconv.Atoi(string(v.AlterID))
+	node := Node{
+		Name:       v.Remarks,
+		Type:       "vmess",
+		Server:     v.Address,
+		Port:       string(v.Port),
+		UUID:       v.ID,
+		AlterID:    &alterID,
+		Cipher:     firstNonEmpty(v.Security, "auto"),
+		TLS:        v.TLS == "tls",
+		ServerName: v.SNI,
+		ALPN:       splitNonEmpty(v.ALPN, ","),
+		UDP:        true,
+	}
+	if node.Name == "" {
+		node.Name = node.Server + ":" + node.Port
+	}
+	switch v.Network {
+	case "", "tcp":
+		if v.Type == "http" {
+			node.Network = "http"
+			node.HTTPOpts = &HTTPOptions{
+				Method: "GET",
+				Path:   splitNonEmpty(firstNonEmpty(v.Path, "/"), ","),
+			}
+			if v.Host != "" {
+				node.HTTPOpts.Headers = map[string][]string{"Host": splitNonEmpty(v.Host, ",")}
+			}
+		}
+	case "ws":
+		node.Network = "ws"
+		node.WSOpts = &WSOptions{Path: firstNonEmpty(v.Path, "/")}
+		if v.Host != "" {
+			node.WSOpts.Headers = map[string]string{"Host": v.Host}
+		}
+	case "h2", "http":
+		node.Network = "h2"
+		node.H2Opts = &H2Options{
+			Host: splitNonEmpty(v.Host, ","),
+			Path: firstNonEmpty(v.Path, "/"),
+		}
+	case "grpc":
+		node.Network = "grpc"
+		node.GrpcOpts = &GrpcOptions{GrpcServiceName: v.Path}
+	default:
+		return nil, fmt.Errorf("unsupported vmess network %q", v.Network)
+	}
+	return &node, nil
+}
+
+// DecodeVMess 解析vmess订阅, 格式与DecodeSS相同, 每行为vmess://<base64_json>
+func DecodeVMess(res *http.Response) ([]Node, error) {
+	return decodeShareLinks(res, vmessPattern, vmessToClash)
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func splitNonEmpty(s, sep string) []string {
+	var out []string
+	for _, item := range strings.Split(s, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+package sub
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var wireguardPattern = regexp.MustCompile("(?i)^(?:wireguard|wg)://(.*)")
+
+// wireguardToClash 解析wireguard分享链接, 输出仅Clash.Meta支持
+// wireguard://privatekey@host:port?publickey=...&address=10.0.0.2/32,fd00::2/128&mtu=1420&reserved=1,2,3#name
+func wireguardToClash(line []byte) (*Node, error) {
+	// 私钥是标准base64, 可能含有未转义的"/", 会被url.Parse当作路径, 先单独取出
+	param := wireguardPattern.FindSubmatch(line)[1]
+	at := bytes.IndexByte(param, '@')
+	if at < 0 {
+		return nil, fmt.Errorf("invalid wireguard link: missing private key")
+	}
+	privateKey, err := url.PathUnescape(string(param[:at]))
+	if err != nil {
+		return nil, err
+	}
+	u, err := parseShareLink(append([]byte("wireguard://key@"), param[at+1:]...))
+	if err != nil {
+		return nil, err
+	}
+	// 公钥等也是标准base64, url.Query会把其中的"+"解码为空格, 按路径的规则解码
+	q, err := pathQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	node := Node{
+		Name:         u.Fragment,
+		Type:         "wireguard",
+		Server:       u.Hostname(),
+		Port:         u.Port(),
+		PrivateKey:   privateKey,
+		PublicKey:    firstNonEmpty(q["publickey"], q["public-key"]),
+		PreSharedKey: firstNonEmpty(q["presharedkey"], q["pre-shared-key"]),
+		UDP:          true,
+	}
+	if node.PublicKey == "" {
+		return nil, fmt.Errorf("invalid wireguard link: missing publickey")
+	}
+	for _, addr := range splitNonEmpty(firstNonEmpty(q["address"], q["ip"]), ",") {
+		// Clash.Meta只需要地址本身, 去掉掩码
+		if i := strings.IndexByte(addr, '/'); i >= 0 {
+			addr = addr[:i]
+		}
+		if strings.Contains(addr, ":") {
+			node.IPv6 = strings.Trim(addr, "[]")
+		} else {
+			node.IP = addr
+		}
+	}
+	if mtu := q["mtu"]; mtu != "" {
+		if node.MTU, err = strconv.Atoi(mtu); err != nil {
+			return nil, fmt.Errorf("invalid wireguard mtu %q", mtu)
+		}
+	}
+	if reserved := q["reserved"]; reserved != "" {
+		if node.Reserved, err = parseReserved(reserved); err != nil {
+			return nil, err
+		}
+	}
+	return &node, nil
+}
+
+// pathQuery 解析查询参数, 与url.ParseQuery不同, "+"不会被当作空格, 同名参数取第一个
+func pathQuery(raw string) (map[string]string, error) {
+	q := make(map[string]string)
+	for _, item := range splitNonEmpty(raw, "&") {
+		k, v, _ := strings.Cut(item, "=")
+		k, err := url.PathUnescape(k)
+		if err != nil {
+			return nil, err
+		}
+		if v, err = url.PathUnescape(v); err != nil {
+			return nil, err
+		}
+		if _, ok := q[k]; !ok {
+			q[k] = v
+		}
+	}
+	return q, nil
+}
+
+// parseReserved 支持"1,2,3"和三字节的base64两种写法
+func parseReserved(s string) ([]int, error) {
+	var reserved []int
+	if strings.Contains(s, ",") {
+		for _, item := range splitNonEmpty(s, ",") {
+			b, err := strconv.Atoi(item)
+			if err != nil || b < 0 || b > 255 {
+				return nil, fmt.Errorf("invalid wireguard reserved %q", s)
+			}
+			reserved = append(reserved, b)
+		}
+	} else {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wireguard reserved %q", s)
+		}
+		for i := range b {
+			reserved = append(reserved, int(b[i]))
+		}
+	}
+	if len(reserved) != 3 {
+		return nil, fmt.Errorf("invalid wireguard reserved %q: need 3 bytes", s)
+	}
+	return reserved, nil
+}
+
+// DecodeWireGuard 解析wireguard订阅, 每行为wireguard://链接
+func DecodeWireGuard(res *http.Response) ([]Node, error) {
+	return decodeShareLinks(res, wireguardPattern, wireguardToClash)
+}